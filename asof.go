@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// LoadGraphAsOf rebuilds the configuration items and relationships as they were at the
+// timestamp at: entities first seen later are left out, entities deleted since then are
+// restored from their Tombstone and the property changes recorded after at are rolled
+// back, those of the relationships included. Entities discovered before first_seen was
+// recorded are always included.
+func LoadGraphAsOf(session neo4j.SessionWithContext, ctx context.Context, at string) (*Graph, error) {
+	params := map[string]any{
+		"at":                at,
+		"bookkeepingLabels": bookkeepingLabels,
+		"bookkeepingTypes":  bookkeepingTypes,
+	}
+	changes := "[(a)-[:HAS_CHANGE]->(c:Change) WHERE c.changed_at > $at | {changed_at: c.changed_at, changes: c.changes}] as changes"
+
+	graph, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		graph := NewGraph()
+
+		nodes, err := collect(ctx, tx, "MATCH (a) WHERE NOT any(l IN labels(a) WHERE l IN $bookkeepingLabels) AND coalesce(a.first_seen, '') <= $at "+
+			"RETURN elementId(a) as id, labels(a)[0] as label, properties(a) as properties, "+changes, params)
+		if err != nil {
+			return nil, err
+		}
+		deletedNodes, err := collect(ctx, tx, "MATCH (a:Tombstone {kind: 'node'}) WHERE a.deleted_at > $at AND a.first_seen <= $at "+
+			"RETURN elementId(a) as id, a.label as label, a.properties as properties, "+changes, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range append(nodes, deletedNodes...) {
+			properties, err := recordProperties(record)
+			if err != nil {
+				return nil, err
+			}
+			err = rollbackChanges(properties, record)
+			if err != nil {
+				return nil, err
+			}
+
+			node := new(Node)
+			node.id = recordString(record, "id")
+			node.class = recordString(record, "label")
+			node.name, _ = properties["name"].(string)
+			node.properties = properties
+			graph.AddNode(node)
+		}
+
+		relationships, err := collect(ctx, tx, "MATCH (a)-[c]->(b) WHERE NOT type(c) IN $bookkeepingTypes AND coalesce(c.first_seen, '') <= $at "+
+			"RETURN elementId(a) as left, type(c) as type, properties(c) as properties, elementId(b) as right, "+
+			"[(a)-[:HAS_RELATIONSHIP_CHANGE]->(h:Change) WHERE h.relationship = elementId(c) AND h.changed_at > $at | {changed_at: h.changed_at, changes: h.changes}] as changes", params)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range relationships {
+			properties, err := recordProperties(record)
+			if err != nil {
+				return nil, err
+			}
+			if err := rollbackChanges(properties, record); err != nil {
+				return nil, err
+			}
+			addGraphRelationship(graph, recordString(record, "left"), recordString(record, "type"), recordString(record, "right"), properties)
+		}
+
+		deletedRelationships, err := collect(ctx, tx, "MATCH (a:Tombstone {kind: 'relationship'}) WHERE a.deleted_at > $at AND a.first_seen <= $at "+
+			"RETURN a.left_label as left_label, a.left_name as left_name, a.type as type, a.properties as properties, a.right_label as right_label, a.right_name as right_name, "+changes, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range deletedRelationships {
+			properties, err := recordProperties(record)
+			if err != nil {
+				return nil, err
+			}
+			if err := rollbackChanges(properties, record); err != nil {
+				return nil, err
+			}
+			left := nodeKey(recordString(record, "left_label"), recordString(record, "left_name"))
+			right := nodeKey(recordString(record, "right_label"), recordString(record, "right_name"))
+			addGraphRelationship(graph, left, recordString(record, "type"), right, properties)
+		}
+
+		return graph, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return graph.(*Graph), nil
+}
+
+func collect(ctx context.Context, tx neo4j.ManagedTransaction, statement string, params map[string]any) ([]*neo4j.Record, error) {
+	result, err := tx.Run(ctx, statement, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Collect(ctx)
+}
+
+// recordProperties returns the "properties" of a record, either a map or the JSON
+// encoded properties of a Tombstone.
+func recordProperties(record *neo4j.Record) (map[string]any, error) {
+	value, _ := record.Get("properties")
+	if encoded, ok := value.(string); ok {
+		properties := map[string]any{}
+		err := json.Unmarshal([]byte(encoded), &properties)
+		return properties, err
+	}
+	if properties, ok := value.(map[string]any); ok {
+		return properties, nil
+	}
+
+	return map[string]any{}, nil
+}
+
+// rollbackChanges restores in properties the values preceding the changes of the
+// record, applying the most recent change first.
+func rollbackChanges(properties map[string]any, record *neo4j.Record) error {
+	value, _ := record.Get("changes")
+	list, _ := value.([]any)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].(map[string]any)["changed_at"].(string) > list[j].(map[string]any)["changed_at"].(string)
+	})
+
+	for _, item := range list {
+		var changes map[string]PropertyChange
+		err := json.Unmarshal([]byte(item.(map[string]any)["changes"].(string)), &changes)
+		if err != nil {
+			return err
+		}
+		for field, change := range changes {
+			if change.Before == nil {
+				delete(properties, field)
+			} else {
+				properties[field] = change.Before
+			}
+		}
+	}
+
+	return nil
+}
+
+func addGraphRelationship(graph *Graph, left string, class string, right string, properties map[string]any) {
+	leftNode := graph.Node(left)
+	rightNode := graph.Node(right)
+	if leftNode == nil || rightNode == nil {
+		return
+	}
+
+	graph.AddRelationship(&Relationship{left: leftNode, class: class, right: rightNode, properties: properties})
+}
+
+// runAsOf prints, or exports as JSON, the CMDB as it was at a past date:
+//
+//	graphcmdb asof [options] <timestamp>
+func runAsOf(args []string) {
+	flags := flag.NewFlagSet("asof", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	server := flags.String("server", "", "only show this server and the items directly attached to it")
+	format := flags.String("format", "text", "output format: text or json")
+	output := flags.String("o", "", "write to this file instead of the standard output")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb asof [options] <timestamp>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	at, err := parseTimestamp(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	driver, err := neoOptions.NewDriver()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer driver.Close(ctx)
+
+	session := driver.NewSession(ctx, neoOptions.SessionConfig(neo4j.AccessModeRead))
+	defer session.Close(ctx)
+
+	graph, err := LoadGraphAsOf(session, ctx, at)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *server != "" {
+		graph = graph.Neighborhood(nodeKey("Server", *server))
+	}
+	graph.Sort()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(graph)
+	} else {
+		fmt.Fprintln(w, "CMDB as of "+at)
+		err = printGraph(w, graph)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// printGraph writes a human readable listing of the nodes, grouped by label, and of
+// the relationships of a graph.
+func printGraph(w io.Writer, graph *Graph) error {
+	label := ""
+	for _, node := range graph.nodes {
+		if node.class != label {
+			label = node.class
+			if _, err := fmt.Fprintln(w, "\n"+label); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(w, "    "+node.name)
+		for _, field := range sortedKeys(node.properties) {
+			if field != "name" {
+				fmt.Fprintln(w, "        "+field+": "+fmt.Sprint(node.properties[field]))
+			}
+		}
+	}
+
+	if len(graph.relationships) > 0 {
+		fmt.Fprintln(w, "\nRelationships")
+	}
+	for _, r := range graph.relationships {
+		if _, err := fmt.Fprintln(w, "    "+r.left.class+" "+r.left.name+" -"+r.class+"-> "+r.right.class+" "+r.right.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
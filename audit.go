@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// AuditLog appends every change written by the stores to a JSON lines file, one
+// ChangeEvent per line. The file is rotated once it reaches maxSize bytes: file.1 is
+// the previous one, file.2 the one before, and so on up to maxFiles rotated files.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+}
+
+// NewAuditLog reads the "audit" section of the configuration and returns nil when it
+// names no file:
+//
+//	"audit": {
+//	    "file": "/var/log/graphcmdb/audit.jsonl",
+//	    "max_size_mb": 100,
+//	    "max_files": 10
+//	}
+func NewAuditLog(config *viper.Viper) (*AuditLog, error) {
+	config.SetDefault("audit.max_size_mb", 100)
+	config.SetDefault("audit.max_files", 10)
+
+	path := config.GetString("audit.file")
+	if path == "" {
+		return nil, nil
+	}
+	audit := &AuditLog{path: path, maxSize: config.GetInt64("audit.max_size_mb") << 20, maxFiles: config.GetInt("audit.max_files")}
+	if audit.maxSize <= 0 || audit.maxFiles < 1 {
+		return nil, errors.New("audit.max_size_mb and audit.max_files must be at least 1")
+	}
+
+	return audit, nil
+}
+
+// Record appends changes to the audit log, rotating it first when they would make it
+// exceed its maximum size.
+func (a *AuditLog) Record(changes []ChangeEvent) error {
+	if a == nil || len(changes) == 0 {
+		return nil
+	}
+
+	var lines []byte
+	for _, change := range changes {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return errors.New("Can't write the audit log: " + err.Error())
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if info, err := os.Stat(a.path); err == nil && info.Size() > 0 && info.Size()+int64(len(lines)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return errors.New("Can't rotate the audit log: " + err.Error())
+		}
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return errors.New("Can't write the audit log: " + err.Error())
+	}
+	_, err = f.Write(lines)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New("Can't write the audit log: " + err.Error())
+	}
+
+	return nil
+}
+
+// rotate renames the file to file.1, after shifting the rotated files and dropping the
+// oldest one.
+func (a *AuditLog) rotate() error {
+	err := os.Remove(a.path + "." + strconv.Itoa(a.maxFiles))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(a.path, a.path+".1")
+}
+
+// auditFiles returns the audit log files of path, the oldest first.
+func auditFiles(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path + "." + strconv.Itoa(i)); err != nil {
+			break
+		}
+		files = append([]string{path + "." + strconv.Itoa(i)}, files...)
+	}
+
+	return append(files, path)
+}
+
+// AuditFilter selects the changes of the audit log, every non empty field having to
+// match.
+type AuditFilter struct {
+	kind   string
+	label  string
+	name   string
+	source string
+	server string
+	runID  string
+	since  string
+	until  string
+}
+
+// Match reports whether change is selected. The label and name match a node or either
+// end of a relationship, the label also matches the type of a relationship.
+func (f *AuditFilter) Match(change *ChangeEvent) bool {
+	ends := []PlannedEndpoint{{Label: change.Label, Name: change.Name}}
+	if change.From != nil && change.To != nil {
+		ends = []PlannedEndpoint{*change.From, *change.To}
+	}
+	matchesEnd := false
+	for _, end := range ends {
+		if (f.label == "" || f.label == end.Label || f.label == change.Type) && (f.name == "" || f.name == end.Name) {
+			matchesEnd = true
+		}
+	}
+
+	return matchesEnd &&
+		(f.kind == "" || f.kind == change.Kind) &&
+		(f.source == "" || f.source == change.Source) &&
+		(f.server == "" || f.server == change.Server) &&
+		(f.runID == "" || f.runID == change.RunID) &&
+		(f.since == "" || change.At >= f.since) &&
+		(f.until == "" || change.At <= f.until)
+}
+
+// SearchAudit calls found with every change of the audit log files of path selected by
+// filter, the oldest first.
+func SearchAudit(path string, filter *AuditFilter, found func(change *ChangeEvent) error) error {
+	for _, fileName := range auditFiles(path) {
+		f, err := os.Open(fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64<<20)
+		for line := 1; scanner.Scan(); line++ {
+			change := new(ChangeEvent)
+			if err := json.Unmarshal(scanner.Bytes(), change); err != nil {
+				f.Close()
+				return errors.New(fileName + ":" + strconv.Itoa(line) + ": " + err.Error())
+			}
+			if filter.Match(change) {
+				if err := found(change); err != nil {
+					f.Close()
+					return err
+				}
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeAuditChange writes a change as a line followed by its properties: every property
+// of a created or deleted item, the changed ones of an update.
+func writeAuditChange(w io.Writer, change *ChangeEvent) {
+	line := change.At + " " + change.Kind + " "
+	if change.From != nil && change.To != nil {
+		line += "(" + change.From.Label + " " + change.From.Name + ")-[" + change.Type + "]->(" + change.To.Label + " " + change.To.Name + ")"
+	} else {
+		line += change.Label + " " + change.Name
+	}
+	var details []string
+	for _, detail := range [][2]string{{"", change.Source}, {"server ", change.Server}, {"run ", change.RunID}} {
+		if detail[1] != "" {
+			details = append(details, detail[0]+detail[1])
+		}
+	}
+	if len(details) > 0 {
+		line += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	switch {
+	case strings.HasSuffix(change.Kind, "_created"):
+		line += formatPlannedProperties(plannedProperties(change.After))
+	case strings.HasSuffix(change.Kind, "_deleted"):
+		line += formatPlannedProperties(plannedProperties(change.Before))
+	}
+	fmt.Fprintln(w, line)
+
+	if strings.HasSuffix(change.Kind, "_updated") {
+		writePlannedChanges(w, diffSnapshots(change.Before, change.After))
+	}
+}
+
+// runAudit searches the audit log:
+//
+//	graphcmdb audit [options]
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	file := flags.String("file", "", "audit log file (default from the audit section of the configuration)")
+	filter := new(AuditFilter)
+	flags.StringVar(&filter.kind, "kind", "", "only show this kind of change, e.g. node_updated or relationship_deleted")
+	flags.StringVar(&filter.label, "label", "", "only show the changes of nodes of this label, or of relationships of this type or with an end of this label")
+	flags.StringVar(&filter.name, "name", "", "only show the changes of the node of this name, or of the relationships with an end of this name")
+	flags.StringVar(&filter.source, "plugin", "", "only show the changes queued by this plugin, or by discovery, an import mapping or manual")
+	flags.StringVar(&filter.server, "server", "", "only show the changes made while discovering or importing this server")
+	flags.StringVar(&filter.runID, "run", "", "only show the changes of this discovery run")
+	since := flags.String("since", "", "only show the changes made from this timestamp")
+	until := flags.String("until", "", "only show the changes made until this timestamp")
+	format := flags.String("format", "text", "output format: text or json, one change per line")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || (*format != "text" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb audit [options]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	path := *file
+	if path == "" && neoOptions.audit != nil {
+		path = neoOptions.audit.path
+	}
+	if path == "" {
+		log.Fatal("No audit log: set -file or the audit section of the configuration")
+	}
+	var err error
+	for _, timestamp := range []struct {
+		value  string
+		target *string
+	}{{*since, &filter.since}, {*until, &filter.until}} {
+		if timestamp.value != "" {
+			*timestamp.target, err = parseTimestamp(timestamp.value)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	err = SearchAudit(path, filter, func(change *ChangeEvent) error {
+		if *format == "json" {
+			return encoder.Encode(change)
+		}
+		writeAuditChange(os.Stdout, change)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
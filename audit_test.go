@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestAuditFilterMatch(t *testing.T) {
+	node := nodeChangeEvent(changeNodeUpdated, &Node{class: "Server", name: "web01"}, map[string]any{"os": "a"}, map[string]any{"os": "b"})
+	node.Source, node.Server, node.RunID, node.At = "packages", "web01", "run1", "2024-05-02T10:00:00Z"
+	relationship := relationshipChangeEvent(changeRelationshipDeleted, "HAS_MOUNT", "Server", "web01", "Storage", "/data", map[string]any{}, nil)
+	relationship.Source, relationship.Server, relationship.RunID, relationship.At = "mounts", "web01", "run2", "2024-05-03T10:00:00Z"
+
+	tests := []struct {
+		name         string
+		filter       AuditFilter
+		node         bool
+		relationship bool
+	}{
+		{"everything", AuditFilter{}, true, true},
+		{"kind", AuditFilter{kind: changeNodeUpdated}, true, false},
+		{"label", AuditFilter{label: "Server"}, true, true},
+		{"label of the right end", AuditFilter{label: "Storage"}, false, true},
+		{"relationship type", AuditFilter{label: "HAS_MOUNT"}, false, true},
+		{"name", AuditFilter{name: "/data"}, false, true},
+		{"label and name", AuditFilter{label: "Server", name: "web01"}, true, true},
+		{"label and name of different ends", AuditFilter{label: "Storage", name: "web01"}, false, false},
+		{"type and name", AuditFilter{label: "HAS_MOUNT", name: "/data"}, false, true},
+		{"plugin", AuditFilter{source: "mounts"}, false, true},
+		{"server", AuditFilter{server: "web02"}, false, false},
+		{"run", AuditFilter{runID: "run1"}, true, false},
+		{"since", AuditFilter{since: "2024-05-03T00:00:00Z"}, false, true},
+		{"until", AuditFilter{until: "2024-05-02T10:00:00Z"}, true, false},
+		{"between", AuditFilter{since: "2024-05-01T00:00:00Z", until: "2024-05-04T00:00:00Z"}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.Match(&node); got != test.node {
+				t.Errorf("node match %v, want %v", got, test.node)
+			}
+			if got := test.filter.Match(&relationship); got != test.relationship {
+				t.Errorf("relationship match %v, want %v", got, test.relationship)
+			}
+		})
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit := &AuditLog{path: path, maxSize: 400, maxFiles: 2}
+	for i := 0; i < 20; i++ {
+		change := nodeChangeEvent(changeNodeCreated, &Node{class: "Server", name: "web" + strconv.Itoa(i)}, nil, map[string]any{"ip": "192.0.2.1"})
+		if err := audit.Record([]ChangeEvent{change}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, fileName := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > audit.maxSize {
+			t.Errorf("%s has %d bytes, more than %d", fileName, info.Size(), audit.maxSize)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("more than %d rotated files", audit.maxFiles)
+	}
+
+	var names []string
+	err := SearchAudit(path, &AuditFilter{}, func(change *ChangeEvent) error {
+		names = append(names, change.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 || names[len(names)-1] != "web19" {
+		t.Fatalf("got %v, want the latest changes up to web19", names)
+	}
+	for i := 1; i < len(names); i++ {
+		previous, _ := strconv.Atoi(names[i-1][3:])
+		current, _ := strconv.Atoi(names[i][3:])
+		if current != previous+1 {
+			t.Errorf("changes out of order: %v", names)
+			break
+		}
+	}
+}
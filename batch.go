@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Relationship write modes of a Batch.
+const (
+	// relationCreate creates the relationship when missing, otherwise only records it has been seen.
+	relationCreate = "create"
+	// relationClaim also claims an existing relationship for the plugin and server of the
+	// new one, unless another plugin owns it, and marks it active.
+	relationClaim = "claim"
+	// relationUpdate also sets the properties of an existing relationship.
+	relationUpdate = "update"
+)
+
+var condRegexp = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*:\s*(?:'([^']*)'|"([^"]*)"|(-?[0-9]+))\s*$`)
+
+// identity returns the properties identifying the node: its keys when set, the
+// properties of its cond, which must be made of "key: 'value'" pairs, or its name.
+func (n *Node) identity() (map[string]any, error) {
+	if n.keys != nil {
+		return n.keys, nil
+	}
+	if n.cond == "" {
+		return map[string]any{"name": n.name}, nil
+	}
+
+	keys := map[string]any{}
+	for _, part := range strings.Split(n.cond, ",") {
+		match := condRegexp.FindStringSubmatch(part)
+		if match == nil {
+			return nil, errors.New("unsupported condition '" + n.cond + "' for " + n.class + " " + n.name)
+		}
+		switch {
+		case match[4] != "":
+			keys[match[1]], _ = strconv.ParseInt(match[4], 10, 64)
+		case match[3] != "":
+			keys[match[1]] = match[3]
+		default:
+			keys[match[1]] = match[2]
+		}
+	}
+
+	return keys, nil
+}
+
+// keysPattern returns "{key: row.<field>.key, ...}" matching the identity keys of a row.
+func keysPattern(keys map[string]any, field string) string {
+	pattern := ""
+	for _, key := range sortedKeys(keys) {
+		if pattern != "" {
+			pattern += ", "
+		}
+		pattern += key + ": row." + field + "." + key
+	}
+
+	return "{" + pattern + "}"
+}
+
+func identitySignature(label string, keys map[string]any) string {
+	return label + "(" + strings.Join(sortedKeys(keys), ",") + ")"
+}
+
+func identityValue(label string, keys map[string]any) string {
+	value := label
+	for _, key := range sortedKeys(keys) {
+		value += "|" + fmt.Sprint(keys[key])
+	}
+
+	return value
+}
+
+// The source of the queued operations is the source of the batch when they are queued,
+// reported in the ChangeEvents.
+
+type batchNode struct {
+	node    *Node
+	keys    map[string]any
+	sources map[string]string
+	source  string
+	create  bool
+	update  bool
+}
+
+type batchRelationship struct {
+	relationship *Relationship
+	leftKeys     map[string]any
+	rightKeys    map[string]any
+	mode         string
+	manual       bool
+	source       string
+}
+
+type batchRemoval struct {
+	node    *Node
+	keys    map[string]any
+	fields  []string
+	indexed string
+	count   int
+	source  string
+}
+
+// removedFields returns the fields removal removes from a node of properties: the listed
+// ones, and the indexed_N ones with N from count it has when indexed is set.
+func (removal batchRemoval) removedFields(properties map[string]any) []string {
+	fields := append([]string{}, removal.fields...)
+	if removal.indexed != "" {
+		for field := range properties {
+			suffix := strings.TrimPrefix(field, removal.indexed+"_")
+			index, err := strconv.Atoi(suffix)
+			if suffix != field && err == nil && index >= removal.count && strconv.Itoa(index) == suffix {
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+type batchReconcile struct {
+	template *Relationship
+	seen     [][]string
+	mode     string
+	source   string
+}
+
+// Batch collects the writes of the discovery of a server, which a GraphStore applies
+// in a single transaction. The Neo4j store groups the nodes and relationships of the
+// same shape in UNWIND statements. The same node or relationship queued several times
+// is written once.
+type Batch struct {
+	source        string
+	server        string
+	run           *DiscoveryRun
+	nodes         []*batchNode
+	nodeIndex     map[string]*batchNode
+	relationships []*batchRelationship
+	relIndex      map[string]*batchRelationship
+	deletes       []*batchRelationship
+	nodeDeletes   []*batchNode
+	removals      []batchRemoval
+	reconciles    []batchReconcile
+
+	// changes are the changes made by the last write, for the notifications and the
+	// audit log.
+	changes []ChangeEvent
+}
+
+func NewBatch() *Batch {
+	return &Batch{nodeIndex: map[string]*batchNode{}, relIndex: map[string]*batchRelationship{}}
+}
+
+// SetSource sets the source recorded in property_sources for the node properties
+// queued next: a plugin name, or manualSource for manual edits.
+func (b *Batch) SetSource(source string) {
+	b.source = source
+}
+
+// SetServer sets the server whose discovery or import queues the writes, reported in
+// the ChangeEvents.
+func (b *Batch) SetServer(server string) {
+	b.server = server
+}
+
+// SetRun sets the discovery run whose id is stamped on the nodes and relationships
+// written and recorded in their history, Tombstones and ChangeEvents.
+func (b *Batch) SetRun(run *DiscoveryRun) {
+	b.run = run
+}
+
+// runID returns the id of the discovery run of the batch, empty when none is set.
+func (b *Batch) runID() string {
+	if b.run == nil {
+		return ""
+	}
+
+	return b.run.id
+}
+
+// UpsertNode queues a node write. A missing node is created only when create is set;
+// the properties of an existing node are set only when update is set. Either way the
+// node is stamped as seen.
+func (b *Batch) UpsertNode(n *Node, create bool, update bool) error {
+	keys, err := n.identity()
+	if err != nil {
+		return err
+	}
+
+	properties := map[string]any{}
+	for k, v := range n.properties {
+		properties[k] = v
+	}
+	properties["name"] = n.name
+
+	id := identityValue(n.class, keys)
+	if queued, found := b.nodeIndex[id]; found {
+		for k, v := range n.properties {
+			if previous, found := queued.node.properties[k]; b.source != "" && (!found || fmt.Sprint(previous) != fmt.Sprint(v)) {
+				queued.sources[k] = b.source
+			}
+		}
+		for k, v := range properties {
+			queued.node.properties[k] = v
+		}
+		queued.create = queued.create || create
+		queued.update = queued.update || update
+		return nil
+	}
+
+	sources := map[string]string{}
+	if b.source != "" {
+		for k := range n.properties {
+			sources[k] = b.source
+		}
+	}
+
+	queued := &batchNode{node: &Node{class: n.class, name: n.name, properties: properties}, keys: keys, sources: sources, source: b.source, create: create, update: update}
+	b.nodes = append(b.nodes, queued)
+	b.nodeIndex[id] = queued
+
+	return nil
+}
+
+// UpsertRelationship queues a relationship write, see relationCreate, relationClaim
+// and relationUpdate. The relationship is created only if both nodes exist when the
+// batch is flushed.
+func (b *Batch) UpsertRelationship(r *Relationship, mode string) error {
+	queued, err := b.newBatchRelationship(r, mode)
+	if err != nil {
+		return err
+	}
+
+	id := identityValue(r.left.class, queued.leftKeys) + "-" + r.class + "->" + identityValue(r.right.class, queued.rightKeys)
+	if existing, found := b.relIndex[id]; found {
+		if mode == relationUpdate {
+			for k, v := range queued.relationship.properties {
+				existing.relationship.properties[k] = v
+			}
+			existing.mode = mode
+		}
+		return nil
+	}
+
+	b.relationships = append(b.relationships, queued)
+	b.relIndex[id] = queued
+
+	return nil
+}
+
+// DeleteRelationship queues the deletion of a relationship, which is kept as a Tombstone.
+func (b *Batch) DeleteRelationship(r *Relationship) error {
+	queued, err := b.newBatchRelationship(r, "")
+	if err != nil {
+		return err
+	}
+	b.deletes = append(b.deletes, queued)
+
+	return nil
+}
+
+// DeleteNode queues the deletion of a node and of its relationships, which are kept as
+// Tombstones.
+func (b *Batch) DeleteNode(n *Node) error {
+	keys, err := n.identity()
+	if err != nil {
+		return err
+	}
+	b.nodeDeletes = append(b.nodeDeletes, &batchNode{node: n, keys: keys, source: b.source})
+
+	return nil
+}
+
+// RemoveProperties queues the removal of properties of a node, along with their
+// sources, so that discovery can set them again.
+func (b *Batch) RemoveProperties(n *Node, fields []string) error {
+	keys, err := n.identity()
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if !identifierRegexp.MatchString(field) {
+			return errors.New("invalid property name '" + field + "'")
+		}
+	}
+	b.removals = append(b.removals, batchRemoval{node: n, keys: keys, fields: fields, source: b.source})
+
+	return nil
+}
+
+// RemoveIndexedProperties queues the removal of the field_N properties of a node with N
+// from count, left over by an indexed aggregation of more rows, like RemoveProperties.
+func (b *Batch) RemoveIndexedProperties(n *Node, field string, count int) error {
+	keys, err := n.identity()
+	if err != nil {
+		return err
+	}
+	if !identifierRegexp.MatchString(field) {
+		return errors.New("invalid property name '" + field + "'")
+	}
+	b.removals = append(b.removals, batchRemoval{node: n, keys: keys, indexed: field, count: count, source: b.source})
+
+	return nil
+}
+
+// Reconcile queues the removal, or marking inactive when mode is "inactive", of every
+// relationship of the same class and node labels as template created by the plugin
+// while discovering the server stored in template properties, and whose
+// [left name, right name] pair is not listed in seen. Relationships owned by other
+// plugins or servers are never touched.
+func (b *Batch) Reconcile(template *Relationship, seen [][]string, mode string) {
+	if seen == nil {
+		seen = [][]string{}
+	}
+	b.reconciles = append(b.reconciles, batchReconcile{template: template, seen: seen, mode: mode, source: b.source})
+}
+
+func (b *Batch) newBatchRelationship(r *Relationship, mode string) (*batchRelationship, error) {
+	leftKeys, err := r.left.identity()
+	if err != nil {
+		return nil, err
+	}
+	rightKeys, err := r.right.identity()
+	if err != nil {
+		return nil, err
+	}
+
+	properties := map[string]any{}
+	for k, v := range r.properties {
+		properties[k] = v
+	}
+
+	return &batchRelationship{
+		relationship: &Relationship{left: r.left, class: r.class, right: r.right, properties: properties},
+		leftKeys:     leftKeys,
+		rightKeys:    rightKeys,
+		mode:         mode,
+		manual:       b.source == manualSource,
+		source:       b.source,
+	}, nil
+}
+
+// empty reports whether nothing has been queued.
+func (b *Batch) empty() bool {
+	return len(b.nodes) == 0 && len(b.relationships) == 0 && len(b.deletes) == 0 && len(b.nodeDeletes) == 0 && len(b.removals) == 0 && len(b.reconciles) == 0
+}
+
+// write runs every queued operation as Cypher statements in tx: nodes first, then
+// relationships, deletions, property removals and reconciliations.
+func (b *Batch) write(ctx context.Context, tx cypherTx) error {
+	seen := seenProperties(b.run)
+	b.changes = nil
+
+	for _, group := range b.nodeGroups() {
+		changes, err := writeNodeGroup(ctx, tx, group, seen, b.runID())
+		if err != nil {
+			return err
+		}
+		b.recordChanges(changes, "")
+	}
+
+	for _, group := range groupRelationships(b.relationships, true) {
+		changes, err := writeRelationshipGroup(ctx, tx, group, seen, b.runID())
+		if err != nil {
+			return err
+		}
+		b.recordChanges(changes, group[0].source)
+	}
+
+	for _, group := range groupRelationships(b.deletes, false) {
+		match, params := relationshipGroupMatch(group)
+		match = "UNWIND $rows as row " + match
+		if !group[0].manual {
+			match += " WHERE coalesce(c.plugin, '') <> $manual"
+			params["manual"] = manualSource
+		}
+		changes, err := recordRelationshipTombstones(ctx, tx, match, params, b.runID())
+		if err != nil {
+			return err
+		}
+		b.recordChanges(changes, group[0].source)
+		if err := runStatement(ctx, tx, match+" DELETE c", params); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range b.nodeDeleteGroups() {
+		rows := make([]map[string]any, len(group))
+		for i, queued := range group {
+			rows[i] = map[string]any{"keys": queued.keys}
+		}
+		params := map[string]any{"rows": rows}
+		match := "UNWIND $rows as row MATCH (n:" + group[0].node.class + " " + keysPattern(group[0].keys, "keys") + ")"
+		changes, err := recordNodeTombstones(ctx, tx, match, params, b.runID())
+		if err != nil {
+			return err
+		}
+		b.recordChanges(changes, group[0].source)
+		if err := runStatement(ctx, tx, match+" DETACH DELETE n", params); err != nil {
+			return err
+		}
+	}
+
+	for _, removal := range b.removals {
+		changes, err := removeProperties(ctx, tx, removal, b.runID())
+		if err != nil {
+			return err
+		}
+		b.recordChanges(changes, removal.source)
+	}
+
+	for _, reconcile := range b.reconciles {
+		changes, err := reconcileRelationships(ctx, tx, reconcile, b.runID())
+		if err != nil {
+			return err
+		}
+		b.recordChanges(changes, reconcile.source)
+	}
+
+	return nil
+}
+
+// recordChanges adds changes to the changes of the write, with the server of the batch
+// and source unless they have their own.
+func (b *Batch) recordChanges(changes []ChangeEvent, source string) {
+	for _, change := range changes {
+		if change.Source == "" {
+			change.Source = source
+		}
+		change.Server = b.server
+		change.RunID = b.runID()
+		b.changes = append(b.changes, change)
+	}
+}
+
+func logReconcile(reconcile batchReconcile, removed int64) {
+	if removed > 0 {
+		log.Println("Reconcile " + reconcile.template.class + ": " + strconv.FormatInt(removed, 10) + " relations no longer reported by " + fmt.Sprint(reconcile.template.properties["plugin"]))
+	}
+}
+
+func (b *Batch) nodeGroups() [][]*batchNode {
+	var groups [][]*batchNode
+	index := map[string]int{}
+	for _, queued := range b.nodes {
+		key := identitySignature(queued.node.class, queued.keys) + strconv.FormatBool(queued.create) + strconv.FormatBool(queued.update)
+		if i, found := index[key]; found {
+			groups[i] = append(groups[i], queued)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []*batchNode{queued})
+	}
+
+	return groups
+}
+
+func (b *Batch) nodeDeleteGroups() [][]*batchNode {
+	var groups [][]*batchNode
+	index := map[string]int{}
+	for _, queued := range b.nodeDeletes {
+		key := identitySignature(queued.node.class, queued.keys) + queued.source
+		if i, found := index[key]; found {
+			groups[i] = append(groups[i], queued)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []*batchNode{queued})
+	}
+
+	return groups
+}
+
+// groupRelationships groups relationships of the same labels, identity keys, class,
+// source and, when byMode is set, write mode.
+func groupRelationships(relationships []*batchRelationship, byMode bool) [][]*batchRelationship {
+	var groups [][]*batchRelationship
+	index := map[string]int{}
+	for _, queued := range relationships {
+		key := identitySignature(queued.relationship.left.class, queued.leftKeys) + queued.relationship.class + identitySignature(queued.relationship.right.class, queued.rightKeys) + queued.source
+		if byMode {
+			key += queued.mode
+		}
+		if i, found := index[key]; found {
+			groups[i] = append(groups[i], queued)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []*batchRelationship{queued})
+	}
+
+	return groups
+}
+
+// writeNodeGroup writes a group of nodes and returns the nodes it creates and the
+// nodes whose properties change.
+func writeNodeGroup(ctx context.Context, tx cypherTx, group []*batchNode, seen map[string]any, runID string) ([]ChangeEvent, error) {
+	first := group[0]
+	rows := make([]map[string]any, len(group))
+	for i, queued := range group {
+		rows[i] = map[string]any{"index": int64(i), "keys": queued.keys, "properties": queued.writeProperties(nil)}
+	}
+	params := map[string]any{"rows": rows, "seen": seen}
+	pattern := "(a:" + first.node.class + " " + keysPattern(first.keys, "keys") + ")"
+
+	var changes []map[string]any
+	var events []ChangeEvent
+	existing := map[int64]bool{}
+	var records []*neo4j.Record
+	if first.create || first.update {
+		var err error
+		records, err = tx.Run(ctx, "UNWIND $rows as row MATCH "+pattern+" RETURN row.index as index, "+tx.ID("a")+" as id, properties(a) as properties", params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range records {
+		index, _ := record.Get("index")
+		existing[index.(int64)] = true
+		if !first.update {
+			continue
+		}
+		id, _ := record.Get("id")
+		before, _ := record.Get("properties")
+		properties := group[index.(int64)].writeProperties(before.(map[string]any))
+		rows[index.(int64)]["properties"] = properties
+		change, err := changeRow(id, before.(map[string]any), properties, runID)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, change)
+			event := nodeChangeEvent(changeNodeUpdated, group[index.(int64)].node, before.(map[string]any), properties)
+			event.Source = group[index.(int64)].source
+			events = append(events, event)
+		}
+	}
+	if first.create {
+		for i, queued := range group {
+			if !existing[int64(i)] {
+				event := nodeChangeEvent(changeNodeCreated, queued.node, nil, mergeProperties(queued.keys, rows[i]["properties"].(map[string]any)))
+				event.Source = queued.source
+				events = append(events, event)
+			}
+		}
+	}
+
+	statement := "UNWIND $rows as row "
+	if first.create {
+		statement += "MERGE " + pattern + " ON CREATE SET a.first_seen = $seen.last_seen"
+		if !first.update {
+			statement += ", a += row.properties"
+		}
+	} else {
+		statement += "MATCH " + pattern
+	}
+	statement += " SET "
+	if first.update {
+		statement += "a += row.properties, "
+	}
+	statement += "a += $seen, a.first_seen = coalesce(a.first_seen, $seen.last_seen)"
+
+	if err := runStatement(ctx, tx, statement, params); err != nil {
+		return nil, err
+	}
+
+	return events, createChanges(ctx, tx, changes)
+}
+
+// writeRelationshipGroup writes a group of relationships and returns the relationships
+// it creates and the relationships whose properties change.
+func writeRelationshipGroup(ctx context.Context, tx cypherTx, group []*batchRelationship, seen map[string]any, runID string) ([]ChangeEvent, error) {
+	first := group[0]
+	rows := make([]map[string]any, len(group))
+	for i, queued := range group {
+		rows[i] = map[string]any{"index": int64(i), "left": queued.leftKeys, "right": queued.rightKeys, "properties": queued.relationship.properties}
+	}
+	params := map[string]any{"rows": rows, "seen": seen}
+
+	records, err := tx.Run(ctx, "UNWIND $rows as row MATCH (a:"+first.relationship.left.class+" "+keysPattern(first.leftKeys, "left")+") "+
+		"MATCH (b:"+first.relationship.right.class+" "+keysPattern(first.rightKeys, "right")+") OPTIONAL MATCH (a)-[c:"+first.relationship.class+"]->(b) "+
+		"RETURN row.index as index, "+tx.ID("a")+" as left_id, a.name as left_name, b.name as right_name, c IS NOT NULL as found, "+tx.ID("c")+" as id, properties(c) as properties", params)
+	if err != nil {
+		return nil, err
+	}
+	var changes []map[string]any
+	var events []ChangeEvent
+	for _, record := range records {
+		index, _ := record.Get("index")
+		found, _ := record.Get("found")
+		before, _ := record.Get("properties")
+		queued := group[index.(int64)]
+		event := relationshipChangeEvent(changeRelationshipCreated, queued.relationship.class, queued.relationship.left.class, recordString(record, "left_name"), queued.relationship.right.class, recordString(record, "right_name"), nil, queued.relationship.properties)
+		if found == true {
+			written := queued.writtenProperties(before.(map[string]any))
+			if len(diffProperties(before.(map[string]any), written)) == 0 {
+				continue
+			}
+			event = relationshipChangeEvent(changeRelationshipUpdated, event.Type, event.From.Label, event.From.Name, event.To.Label, event.To.Name, before.(map[string]any), written)
+			id, _ := record.Get("id")
+			leftID, _ := record.Get("left_id")
+			change, err := relationshipChangeRow(id, leftID, event.Type, before.(map[string]any), written, runID)
+			if err != nil {
+				return nil, err
+			}
+			if change != nil {
+				changes = append(changes, change)
+			}
+		}
+		events = append(events, event)
+	}
+	if err := createRelationshipChanges(ctx, tx, changes); err != nil {
+		return nil, err
+	}
+
+	statement := "UNWIND $rows as row MATCH (a:" + first.relationship.left.class + " " + keysPattern(first.leftKeys, "left") + ") " +
+		"MATCH (b:" + first.relationship.right.class + " " + keysPattern(first.rightKeys, "right") + ") " +
+		"MERGE (a)-[c:" + first.relationship.class + "]->(b) ON CREATE SET c += row.properties, c.first_seen = $seen.last_seen SET "
+	switch first.mode {
+	case relationClaim:
+		statement += "c.active = CASE WHEN c.plugin IS NULL OR c.plugin = row.properties.plugin THEN true ELSE c.active END, " +
+			"c.server = CASE WHEN c.plugin IS NULL OR c.plugin = row.properties.plugin THEN row.properties.server ELSE c.server END, " +
+			"c.plugin = coalesce(c.plugin, row.properties.plugin), "
+	case relationUpdate:
+		if first.manual {
+			statement += "c += row.properties, "
+		} else {
+			statement += "c += CASE WHEN c.plugin = $manual THEN {} ELSE row.properties END, "
+			params["manual"] = manualSource
+		}
+	}
+	statement += "c += $seen, c.first_seen = coalesce(c.first_seen, $seen.last_seen)"
+
+	return events, runStatement(ctx, tx, statement, params)
+}
+
+// writtenProperties returns the properties the queued relationship sets on a
+// relationship whose current properties are before, as writeRelationshipGroup does.
+func (q *batchRelationship) writtenProperties(before map[string]any) map[string]any {
+	properties := q.relationship.properties
+	switch q.mode {
+	case relationClaim:
+		if before["plugin"] == nil || before["plugin"] == properties["plugin"] {
+			return map[string]any{"active": true, "server": properties["server"], "plugin": properties["plugin"]}
+		}
+	case relationUpdate:
+		if q.manual || before["plugin"] != manualSource {
+			return properties
+		}
+	}
+
+	return map[string]any{}
+}
+
+// relationshipGroupMatch returns a MATCH binding (a)-[c]->(b) for every row of the
+// group, to be prefixed by "UNWIND $rows as row", along with its parameters.
+func relationshipGroupMatch(group []*batchRelationship) (string, map[string]any) {
+	first := group[0]
+	rows := make([]map[string]any, len(group))
+	for i, queued := range group {
+		rows[i] = map[string]any{"left": queued.leftKeys, "right": queued.rightKeys}
+	}
+
+	match := "MATCH (a:" + first.relationship.left.class + " " + keysPattern(first.leftKeys, "left") + ")-[c:" + first.relationship.class + "]->" +
+		"(b:" + first.relationship.right.class + " " + keysPattern(first.rightKeys, "right") + ")"
+
+	return match, map[string]any{"rows": rows}
+}
+
+// reconcileRelationships deletes or marks inactive the relationships no longer reported
+// and returns these changes.
+func reconcileRelationships(ctx context.Context, tx cypherTx, reconcile batchReconcile, runID string) ([]ChangeEvent, error) {
+	r := reconcile.template
+	match := "MATCH (a:" + r.left.class + ")-[c:" + r.class + " {plugin: $plugin, server: $server}]->(b:" + r.right.class + ") WHERE NOT [a.name, b.name] IN $seen"
+	action := "DELETE c"
+	if reconcile.mode == "inactive" {
+		match += " AND coalesce(c.active, true)"
+		action = "SET c.active = false"
+	}
+	params := map[string]any{
+		"plugin": r.properties["plugin"],
+		"server": r.properties["server"],
+		"seen":   reconcile.seen,
+	}
+
+	var changes []ChangeEvent
+	var err error
+	if reconcile.mode != "inactive" {
+		changes, err = recordRelationshipTombstones(ctx, tx, match, params, runID)
+	} else {
+		changes, err = relationshipChanges(ctx, tx, match, params, map[string]any{"active": false}, runID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := tx.Run(ctx, match+" "+action+" return count(c) as count", params)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 {
+		count, _ := records[0].Get("count")
+		logReconcile(reconcile, count.(int64))
+	}
+
+	return changes, nil
+}
+
+// relationshipChanges returns the changes of setting the written properties on the
+// relationships matched by match, which binds (a)-[c]->(b), and records them in their
+// history. It must run before they are set.
+func relationshipChanges(ctx context.Context, tx cypherTx, match string, params map[string]any, written map[string]any, runID string) ([]ChangeEvent, error) {
+	records, err := tx.Run(ctx, match+" RETURN "+tx.ID("a")+" as left_id, "+tx.Label("a")+" as left_label, a.name as left_name, type(c) as type, "+tx.ID("c")+" as id, properties(c) as properties, "+
+		tx.Label("b")+" as right_label, b.name as right_name", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]any
+	var changes []ChangeEvent
+	for _, record := range records {
+		id, _ := record.Get("id")
+		leftID, _ := record.Get("left_id")
+		before, _ := record.Get("properties")
+		row, err := relationshipChangeRow(id, leftID, recordString(record, "type"), before.(map[string]any), written, runID)
+		if err != nil {
+			return nil, err
+		}
+		if row != nil {
+			rows = append(rows, row)
+		}
+		changes = append(changes, relationshipChangeEvent(changeRelationshipUpdated, recordString(record, "type"), recordString(record, "left_label"), recordString(record, "left_name"),
+			recordString(record, "right_label"), recordString(record, "right_name"), before.(map[string]any), written))
+	}
+
+	return changes, createRelationshipChanges(ctx, tx, rows)
+}
+
+// removeProperties removes the fields of the node of removal and their sources,
+// recording the removal in the history of the node, and returns the node change.
+func removeProperties(ctx context.Context, tx cypherTx, removal batchRemoval, runID string) ([]ChangeEvent, error) {
+	params := map[string]any{"rows": []map[string]any{{"keys": removal.keys}}}
+	records, err := tx.Run(ctx, "UNWIND $rows as row MATCH (a:"+removal.node.class+" "+keysPattern(removal.keys, "keys")+") RETURN "+tx.ID("a")+" as id, properties(a) as properties", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []map[string]any
+	var events []ChangeEvent
+	for _, record := range records {
+		id, _ := record.Get("id")
+		before, _ := record.Get("properties")
+		fields := removal.removedFields(before.(map[string]any))
+		if len(fields) == 0 {
+			continue
+		}
+		remove := make([]string, len(fields))
+		for i, field := range fields {
+			remove[i] = "a." + field
+		}
+		removed := map[string]any{}
+		sources := propertySources(before.(map[string]any))
+		for _, field := range fields {
+			if _, found := before.(map[string]any)[field]; found {
+				removed[field] = nil
+			}
+			delete(sources, field)
+		}
+
+		var entries any
+		if len(sources) > 0 {
+			entries = formatPropertySources(sources)
+		}
+		err := runStatement(ctx, tx, "MATCH (a) WHERE "+tx.ID("a")+" = $id SET a."+propertySourcesField+" = $sources REMOVE "+strings.Join(remove, ", "), map[string]any{"id": id, "sources": entries})
+		if err != nil {
+			return nil, err
+		}
+
+		change, err := changeRow(id, before.(map[string]any), removed, runID)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, change)
+			events = append(events, nodeChangeEvent(changeNodeUpdated, removal.node, before.(map[string]any), removed))
+		}
+	}
+
+	return events, createChanges(ctx, tx, changes)
+}
+
+func runStatement(ctx context.Context, tx cypherTx, statement string, params map[string]any) error {
+	_, err := tx.Run(ctx, statement, params)
+
+	return err
+}
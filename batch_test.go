@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNodeIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		node *Node
+		want map[string]any
+	}{
+		{"name", &Node{name: "web01"}, map[string]any{"name": "web01"}},
+		{"quoted", &Node{name: "web01", cond: "ip: '192.0.2.1'"}, map[string]any{"ip": "192.0.2.1"}},
+		{"double quoted", &Node{name: "web01", cond: `ip: "192.0.2.1"`}, map[string]any{"ip": "192.0.2.1"}},
+		{"integer", &Node{name: "db", cond: "port: -3306"}, map[string]any{"port": int64(-3306)}},
+		{"several keys", &Node{name: "db", cond: "host: 'web01', port: 3306"}, map[string]any{"host": "web01", "port": int64(3306)}},
+		{"keys", &Node{name: "db", cond: "ip: '192.0.2.1'", keys: map[string]any{"id": "x"}}, map[string]any{"id": "x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.node.identity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	for _, cond := range []string{"ip = '192.0.2.1'", "ip: 192.0.2.1", "n.ip: '192.0.2.1'", "ip: 'a' OR 1=1"} {
+		if _, err := (&Node{class: "Server", name: "web01", cond: cond}).identity(); err == nil {
+			t.Errorf("condition %q accepted", cond)
+		}
+	}
+}
+
+func TestBatchMergesQueuedNodes(t *testing.T) {
+	batch := NewBatch()
+	batch.SetSource("packages")
+	if err := batch.UpsertNode(testServer(map[string]any{"os": "linux", "kernel": "6.1"}), false, true); err != nil {
+		t.Fatal(err)
+	}
+	batch.SetSource("kernel")
+	if err := batch.UpsertNode(testServer(map[string]any{"os": "linux", "kernel": "6.2"}), true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.nodes) != 1 {
+		t.Fatalf("got %d queued nodes, want 1", len(batch.nodes))
+	}
+	queued := batch.nodes[0]
+	if !queued.create || !queued.update {
+		t.Errorf("create %v and update %v, want both", queued.create, queued.update)
+	}
+	if want := map[string]any{"name": "web01", "os": "linux", "kernel": "6.2"}; !reflect.DeepEqual(queued.node.properties, want) {
+		t.Errorf("properties %v, want %v", queued.node.properties, want)
+	}
+	if want := map[string]string{"os": "packages", "kernel": "kernel"}; !reflect.DeepEqual(queued.sources, want) {
+		t.Errorf("sources %v, want %v", queued.sources, want)
+	}
+}
+
+func TestBatchMergesQueuedRelationships(t *testing.T) {
+	batch := NewBatch()
+	for _, queued := range []struct {
+		properties map[string]any
+		mode       string
+	}{
+		{map[string]any{"pid": "1"}, relationCreate},
+		{map[string]any{"pid": "2", "port": "80"}, relationUpdate},
+		{map[string]any{"pid": "3"}, relationCreate},
+	} {
+		r := &Relationship{left: testServer(nil), class: "RUNNING", right: &Node{class: "Service", name: "nginx"}, properties: queued.properties}
+		if err := batch.UpsertRelationship(r, queued.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(batch.relationships) != 1 {
+		t.Fatalf("got %d queued relationships, want 1", len(batch.relationships))
+	}
+	queued := batch.relationships[0]
+	if queued.mode != relationUpdate {
+		t.Errorf("mode %s, want %s", queued.mode, relationUpdate)
+	}
+	if want := map[string]any{"pid": "2", "port": "80"}; !reflect.DeepEqual(queued.relationship.properties, want) {
+		t.Errorf("properties %v, want %v", queued.relationship.properties, want)
+	}
+}
+
+func TestBatchRemovePropertiesNames(t *testing.T) {
+	for _, field := range []string{"owner", "_private", "disk2"} {
+		if err := NewBatch().RemoveProperties(testServer(nil), []string{field}); err != nil {
+			t.Errorf("%s rejected: %v", field, err)
+		}
+	}
+	for _, field := range []string{"", "a.b", "2disks", "owner, n.ip"} {
+		if err := NewBatch().RemoveProperties(testServer(nil), []string{field}); err == nil {
+			t.Errorf("%q accepted", field)
+		}
+	}
+}
+
+func TestBatchGroups(t *testing.T) {
+	batch := NewBatch()
+	queue := func(source string, mode string, service string) {
+		batch.SetSource(source)
+		r := &Relationship{left: testServer(nil), class: "RUNNING", right: &Node{class: "Service", name: service}, properties: map[string]any{}}
+		if err := batch.UpsertRelationship(r, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.DeleteRelationship(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.UpsertNode(&Node{class: "Service", name: service}, mode == relationCreate, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue("services", relationCreate, "nginx")
+	queue("services", relationCreate, "sshd")
+	queue("services", relationUpdate, "cron")
+	queue(manualSource, relationCreate, "backup")
+
+	if got := len(groupRelationships(batch.relationships, true)); got != 3 {
+		t.Errorf("got %d write groups, want 3", got)
+	}
+	if got := len(groupRelationships(batch.deletes, false)); got != 2 {
+		t.Errorf("got %d delete groups, want 2", got)
+	}
+	if got := len(batch.nodeGroups()); got != 2 {
+		t.Errorf("got %d node groups, want 2", got)
+	}
+}
+
+func TestWrittenProperties(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		source string
+		before map[string]any
+		want   map[string]any
+	}{
+		{"create", relationCreate, "mounts", map[string]any{"plugin": "nfs"}, map[string]any{}},
+		{"claim an unowned relationship", relationClaim, "mounts", map[string]any{}, map[string]any{"active": true, "plugin": "mounts", "server": "web01"}},
+		{"claim an own relationship", relationClaim, "mounts", map[string]any{"plugin": "mounts", "active": false}, map[string]any{"active": true, "plugin": "mounts", "server": "web01"}},
+		{"claim a relationship of another plugin", relationClaim, "mounts", map[string]any{"plugin": "nfs"}, map[string]any{}},
+		{"update", relationUpdate, "mounts", map[string]any{"plugin": "nfs"}, map[string]any{"plugin": "mounts", "server": "web01", "source": "fstab"}},
+		{"update a manual relationship", relationUpdate, "mounts", map[string]any{"plugin": manualSource}, map[string]any{}},
+		{"update a manual relationship manually", relationUpdate, manualSource, map[string]any{"plugin": manualSource}, map[string]any{"plugin": "mounts", "server": "web01", "source": "fstab"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := NewBatch()
+			batch.SetSource(test.source)
+			mount := testMount("mounts", "web01", "/data")
+			mount.properties["source"] = "fstab"
+			queued, err := batch.newBatchRelationship(mount, test.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := queued.writtenProperties(test.before); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
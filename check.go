@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	checkRunning = "running"
+	checkStopped = "stopped"
+	checkUnknown = "unknown"
+)
+
+// CheckResult is the outcome of one service check plugin on one server.
+type CheckResult struct {
+	server  string
+	plugin  string
+	target  string
+	state   string
+	details map[string]any
+}
+
+// parseCheckOutput splits the output of a service check script into its status, the
+// first non empty line, and the details reported on the following "key=value" lines,
+// e.g.
+//
+//	1
+//	version=10.6.12
+//	port=3306
+//	pid=1234
+//	config=/etc/my.cnf
+func parseCheckOutput(out string) (string, map[string]any) {
+	status := ""
+	details := map[string]any{}
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if status == "" {
+			status = line
+			continue
+		}
+
+		field, value, found := strings.Cut(line, "=")
+		field = strings.TrimSpace(field)
+		if !found || !identifierRegexp.MatchString(field) {
+			log.Println("Skip invalid detail line " + line)
+			continue
+		}
+		details[field] = strings.TrimSpace(value)
+	}
+
+	return status, details
+}
+
+func printCheckReport(report []CheckResult) {
+	if len(report) == 0 {
+		return
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		if report[i].server != report[j].server {
+			return report[i].server < report[j].server
+		}
+		return report[i].plugin < report[j].plugin
+	})
+
+	log.Println("--- Service check report")
+	unknown := 0
+	for _, result := range report {
+		line := result.server + " " + result.target + " (" + result.plugin + "): " + result.state
+		for _, field := range sortedKeys(result.details) {
+			line += " " + field + "=" + result.details[field].(string)
+		}
+		if result.state == checkUnknown {
+			unknown++
+		}
+		log.Println(line)
+	}
+	if unknown > 0 {
+		log.Println("--- " + strconv.Itoa(unknown) + " checks returned an unknown state")
+	}
+}
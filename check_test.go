@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCheckOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		status  string
+		details map[string]any
+	}{
+		{"empty", "", "", map[string]any{}},
+		{"status only", "1\n", "1", map[string]any{}},
+		{"details", "\n  0 \nversion=10.6.12\nport = 3306\n\nconfig=/etc/my.cnf\n", "0", map[string]any{"version": "10.6.12", "port": "3306", "config": "/etc/my.cnf"}},
+		{"value with equals", "1\nopts=-Xmx=2g\n", "1", map[string]any{"opts": "-Xmx=2g"}},
+		{"empty value", "1\npid=\n", "1", map[string]any{"pid": ""}},
+		{"invalid lines", "1\nno separator\nn.ip=1\n2port=1\nport=80\n", "1", map[string]any{"port": "80"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, details := parseCheckOutput(test.out)
+			if status != test.status {
+				t.Errorf("status %q, want %q", status, test.status)
+			}
+			if !reflect.DeepEqual(details, test.details) {
+				t.Errorf("details %v, want %v", details, test.details)
+			}
+		})
+	}
+}
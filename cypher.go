@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// cypherTx runs Cypher statements in a transaction of one of the supported graph
+// databases, hiding the differences between their Cypher dialects.
+type cypherTx interface {
+	// Run runs statement with params and collects the records it returns.
+	Run(ctx context.Context, statement string, params map[string]any) ([]*neo4j.Record, error)
+	// ID returns the expression of the internal id of the node or relationship bound to variable.
+	ID(variable string) string
+	// Label returns the expression of the label of the node bound to variable.
+	Label(variable string) string
+}
+
+// boltTx is a cypherTx over a Bolt transaction: elementId() identifies entities on Neo4j
+// 5, id() on Memgraph.
+type boltTx struct {
+	tx         neo4j.ManagedTransaction
+	idFunction string
+}
+
+func neo4jTx(tx neo4j.ManagedTransaction) boltTx {
+	return boltTx{tx: tx, idFunction: "elementId"}
+}
+
+func (t boltTx) Run(ctx context.Context, statement string, params map[string]any) ([]*neo4j.Record, error) {
+	return collect(ctx, t.tx, statement, params)
+}
+
+func (t boltTx) ID(variable string) string {
+	return t.idFunction + "(" + variable + ")"
+}
+
+func (t boltTx) Label(variable string) string {
+	return "labels(" + variable + ")[0]"
+}
+
+// queryGraph loads the current configuration items and relationships, leaving out the
+// bookkeeping ones.
+func queryGraph(ctx context.Context, tx cypherTx) (*Graph, error) {
+	graph := NewGraph()
+
+	nodes, err := tx.Run(ctx, "MATCH (a) RETURN "+tx.ID("a")+" as id, "+tx.Label("a")+" as label, properties(a) as properties", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range nodes {
+		if isBookkeeping(recordString(record, "label")) {
+			continue
+		}
+		properties, err := recordProperties(record)
+		if err != nil {
+			return nil, err
+		}
+
+		node := new(Node)
+		node.id = recordString(record, "id")
+		node.class = recordString(record, "label")
+		node.name, _ = properties["name"].(string)
+		node.properties = properties
+		graph.AddNode(node)
+	}
+
+	relationships, err := tx.Run(ctx, "MATCH (a)-[c]->(b) RETURN "+tx.ID("a")+" as left, type(c) as type, properties(c) as properties, "+tx.ID("b")+" as right", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range relationships {
+		if isBookkeeping(recordString(record, "type")) {
+			continue
+		}
+		properties, err := recordProperties(record)
+		if err != nil {
+			return nil, err
+		}
+		addGraphRelationship(graph, recordString(record, "left"), recordString(record, "type"), recordString(record, "right"), properties)
+	}
+
+	return graph, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/spf13/viper"
+)
+
+// Graph database backends. Neo4j is the reference: the prune, history, asof and schema
+// commands only run against it.
+const (
+	backendNeo4j    = "neo4j"
+	backendMemgraph = "memgraph"
+)
+
+// Neo4jOptions holds the settings used to connect to the graph database. The settings
+// not given on the command line are read by LoadConfig.
+type Neo4jOptions struct {
+	host     string
+	port     string
+	user     string
+	pass     string
+	backend  string
+	database string
+
+	// Bolt connection settings.
+	scheme             string
+	caFile             string
+	auth               string
+	token              string
+	maxPoolSize        int
+	maxLifetime        time.Duration
+	acquisitionTimeout time.Duration
+	connectTimeout     time.Duration
+
+	// notifier posts the changes written by the store to the webhooks, nil when none.
+	notifier *Notifier
+	// audit records the changes written by the store, nil when disabled.
+	audit *AuditLog
+}
+
+func (o *Neo4jOptions) AddFlags(flags *flag.FlagSet) {
+	o.LoadConfig()
+	flags.StringVar(&o.host, "neo-host", o.host, "Neo4j host")
+	flags.StringVar(&o.port, "neo-port", o.port, "Neo4j port")
+	flags.StringVar(&o.user, "neo-user", o.user, "Neo4j user")
+	flags.Func("neo-pass", "Neo4j password (default from the configuration)", func(value string) error {
+		o.pass = value
+		return nil
+	})
+	flags.StringVar(&o.backend, "backend", o.backend, "graph database: neo4j or memgraph")
+	flags.StringVar(&o.database, "database", o.database, "Neo4j database")
+	flags.StringVar(&o.scheme, "neo-scheme", o.scheme, "Bolt URI scheme: neo4j, neo4j+s, neo4j+ssc, bolt, bolt+s or bolt+ssc")
+}
+
+// LoadConfig sets the options left empty from the JSON configuration file named by the
+// GRAPHCMDB_CONFIG environment variable, ./graphcmdb.json by default, whose keys can be
+// overridden by GRAPHCMDB_<KEY> environment variables:
+//
+//	backend                         neo4j (default) or memgraph
+//	host, port, user, password      connection, localhost:7687 and user neo4j by default
+//	database                        Neo4j database, default one when empty
+//	scheme                          Bolt URI scheme, neo4j (bolt for memgraph) by default
+//	ca_file                         PEM certificates trusted by the neo4j+s and bolt+s schemes
+//	auth                            basic (default), bearer or none
+//	token                           bearer token
+//	max_connection_pool_size        Bolt connection pool size
+//	max_connection_lifetime         e.g. "1h"
+//	connection_acquisition_timeout  e.g. "1m"
+//	socket_connect_timeout          e.g. "5s"
+//	notifications                   webhooks notified of the changes, see NewNotifier
+//	audit                           JSON lines log of the changes, see NewAuditLog
+func (o *Neo4jOptions) LoadConfig() {
+	config := viper.New()
+	config.SetConfigType("json")
+	config.SetEnvPrefix("graphcmdb")
+	config.AutomaticEnv()
+	config.SetDefault("backend", backendNeo4j)
+	config.SetDefault("host", "localhost")
+	config.SetDefault("port", "7687")
+	config.SetDefault("user", "neo4j")
+	config.SetDefault("auth", "basic")
+
+	fileName := os.Getenv("GRAPHCMDB_CONFIG")
+	config.SetConfigFile(fileName)
+	if fileName == "" {
+		config.SetConfigFile("graphcmdb.json")
+	}
+	err := config.ReadInConfig()
+	if err != nil && (fileName != "" || !errors.Is(err, fs.ErrNotExist)) {
+		log.Fatal("Can't read configuration: " + err.Error())
+	}
+
+	setDefault(&o.backend, config.GetString("backend"))
+	setDefault(&o.host, config.GetString("host"))
+	setDefault(&o.port, config.GetString("port"))
+	setDefault(&o.user, config.GetString("user"))
+	setDefault(&o.pass, config.GetString("password"))
+	setDefault(&o.database, config.GetString("database"))
+	setDefault(&o.scheme, config.GetString("scheme"))
+	setDefault(&o.caFile, config.GetString("ca_file"))
+	setDefault(&o.auth, config.GetString("auth"))
+	setDefault(&o.token, config.GetString("token"))
+	if o.maxPoolSize == 0 {
+		o.maxPoolSize = config.GetInt("max_connection_pool_size")
+	}
+	if o.maxLifetime == 0 {
+		o.maxLifetime = config.GetDuration("max_connection_lifetime")
+	}
+	if o.acquisitionTimeout == 0 {
+		o.acquisitionTimeout = config.GetDuration("connection_acquisition_timeout")
+	}
+	if o.connectTimeout == 0 {
+		o.connectTimeout = config.GetDuration("socket_connect_timeout")
+	}
+
+	o.notifier, err = NewNotifier(config)
+	if err != nil {
+		log.Fatal("Can't read configuration: " + err.Error())
+	}
+	o.audit, err = NewAuditLog(config)
+	if err != nil {
+		log.Fatal("Can't read configuration: " + err.Error())
+	}
+}
+
+// setDefault sets option to value unless it is already set.
+func setDefault(option *string, value string) {
+	if *option == "" {
+		*option = value
+	}
+}
+
+// NewDriver connects to Neo4j, for the commands relying on Neo4j features.
+func (o *Neo4jOptions) NewDriver() (neo4j.DriverWithContext, error) {
+	if o.backend != backendNeo4j {
+		return nil, errors.New("this command requires the neo4j backend, not " + o.backend)
+	}
+
+	return o.boltDriver()
+}
+
+// SessionConfig returns the configuration of the sessions on the configured database.
+func (o *Neo4jOptions) SessionConfig(mode neo4j.AccessMode) neo4j.SessionConfig {
+	return neo4j.SessionConfig{AccessMode: mode, DatabaseName: o.database}
+}
+
+func (o *Neo4jOptions) boltDriver() (neo4j.DriverWithContext, error) {
+	scheme := o.scheme
+	if scheme == "" {
+		scheme = "neo4j"
+		if o.backend == backendMemgraph {
+			scheme = "bolt"
+		}
+	}
+	dbUri := scheme + "://" + net.JoinHostPort(o.host, o.port)
+
+	var auth neo4j.AuthToken
+	switch o.auth {
+	case "basic":
+		auth = neo4j.BasicAuth(o.user, o.pass, "")
+	case "bearer":
+		auth = neo4j.BearerAuth(o.token)
+	case "none":
+		auth = neo4j.NoAuth()
+	default:
+		return nil, errors.New("unknown auth " + o.auth + ", expected basic, bearer or none")
+	}
+
+	var tlsConfig *tls.Config
+	if o.caFile != "" {
+		if !strings.HasSuffix(scheme, "+s") {
+			return nil, errors.New("ca_file requires the neo4j+s or bolt+s scheme")
+		}
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + o.caFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	log.Println("Connecting to " + o.backend + " at " + dbUri)
+	driver, err := neo4j.NewDriverWithContext(dbUri, auth, func(c *neo4j.Config) {
+		c.TlsConfig = tlsConfig
+		if o.maxPoolSize != 0 {
+			c.MaxConnectionPoolSize = o.maxPoolSize
+		}
+		if o.maxLifetime != 0 {
+			c.MaxConnectionLifetime = o.maxLifetime
+		}
+		if o.acquisitionTimeout != 0 {
+			c.ConnectionAcquisitionTimeout = o.acquisitionTimeout
+		}
+		if o.connectTimeout != 0 {
+			c.SocketConnectTimeout = o.connectTimeout
+		}
+	})
+	if err != nil {
+		return nil, errors.New("Can't connect to " + o.backend + " database " + dbUri + ": " + err.Error())
+	}
+
+	return driver, nil
+}
+
+// NewStore connects to the GraphStore of the configured backend.
+func NewStore(ctx context.Context, options *Neo4jOptions) (GraphStore, error) {
+	switch options.backend {
+	case backendNeo4j, backendMemgraph:
+		return NewNeo4jStore(ctx, options)
+	}
+
+	return nil, errors.New("unknown graph database backend " + options.backend)
+}
+
+// Neo4jStore is the GraphStore writing to Neo4j, or to Memgraph through Bolt, each
+// Batch in one write transaction.
+type Neo4jStore struct {
+	driver     neo4j.DriverWithContext
+	session    neo4j.SessionWithContext
+	idFunction string
+	notifier   *Notifier
+	audit      *AuditLog
+}
+
+func NewNeo4jStore(ctx context.Context, options *Neo4jOptions) (*Neo4jStore, error) {
+	driver, err := options.boltDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Neo4jStore{driver: driver, idFunction: "elementId", notifier: options.notifier, audit: options.audit}
+	if options.backend == backendMemgraph {
+		store.idFunction = "id"
+	}
+	store.session = driver.NewSession(ctx, options.SessionConfig(neo4j.AccessModeWrite))
+
+	return store, nil
+}
+
+func (s *Neo4jStore) Apply(ctx context.Context, batch *Batch) error {
+	if batch.empty() {
+		return nil
+	}
+
+	log.Println("Write " + strconv.Itoa(len(batch.nodes)) + " nodes and " + strconv.Itoa(len(batch.relationships)) + " relations to the graph database")
+	_, err := s.session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		return nil, batch.write(ctx, boltTx{tx: tx, idFunction: s.idFunction})
+	})
+	if err != nil {
+		return err
+	}
+	s.notifier.Notify(batch.changes)
+	if err := s.audit.Record(batch.changes); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) Query(ctx context.Context) (*Graph, error) {
+	graph, err := s.session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		return queryGraph(ctx, boltTx{tx: tx, idFunction: s.idFunction})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return graph.(*Graph), nil
+}
+
+func (s *Neo4jStore) Close(ctx context.Context) error {
+	s.notifier.Close()
+	s.session.Close(ctx)
+
+	return s.driver.Close(ctx)
+}
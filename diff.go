@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// RunDiff lists the changes between the graph as it was at the end of two discovery
+// runs.
+type RunDiff struct {
+	From DiffedRun `json:"from"`
+	To   DiffedRun `json:"to"`
+	*Plan
+}
+
+// DiffedRun is a discovery run and the timestamp of its snapshot.
+type DiffedRun struct {
+	ID string `json:"id"`
+	At string `json:"at"`
+}
+
+// loadRunEnd returns the ended_at timestamp of a discovery run.
+func loadRunEnd(session neo4j.SessionWithContext, ctx context.Context, id string) (string, error) {
+	records, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		return collect(ctx, tx, "MATCH (r:DiscoveryRun {name: $id}) RETURN r.ended_at as ended_at", map[string]any{"id": id})
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(records.([]*neo4j.Record)) == 0 {
+		return "", errors.New("unknown discovery run " + id)
+	}
+	endedAt := recordString(records.([]*neo4j.Record)[0], "ended_at")
+	if endedAt == "" {
+		return "", errors.New("discovery run " + id + " has not finished")
+	}
+
+	return endedAt, nil
+}
+
+// keyedGraph copies graph with every node identified by its label and name, so that
+// snapshots loaded separately can be compared by NewPlan.
+func keyedGraph(graph *Graph) *Graph {
+	keyed := NewGraph()
+	for _, n := range graph.nodes {
+		keyed.AddNode(&Node{id: nodeKey(n.class, n.name), class: n.class, name: n.name, properties: n.properties})
+	}
+	for _, r := range graph.relationships {
+		left, right := keyed.Node(nodeKey(r.left.class, r.left.name)), keyed.Node(nodeKey(r.right.class, r.right.name))
+		keyed.AddRelationship(&Relationship{left: left, class: r.class, right: right, properties: r.properties})
+	}
+
+	return keyed
+}
+
+// NewRunDiff compares two snapshots, keeping the nodes of labels and the relationships
+// with a node of labels at either end when labels is not empty.
+func NewRunDiff(from DiffedRun, before *Graph, to DiffedRun, after *Graph, labels []string) *RunDiff {
+	plan := NewPlan(keyedGraph(before), keyedGraph(after))
+	if len(labels) > 0 {
+		nodes := []PlannedNode{}
+		for _, n := range plan.Nodes {
+			if isAllowed(n.Label, labels) {
+				nodes = append(nodes, n)
+			}
+		}
+		relationships := []PlannedRelationship{}
+		for _, r := range plan.Relationships {
+			if isAllowed(r.From.Label, labels) || isAllowed(r.To.Label, labels) {
+				relationships = append(relationships, r)
+			}
+		}
+		plan.Nodes, plan.Relationships = nodes, relationships
+	}
+
+	return &RunDiff{From: from, To: to, Plan: plan}
+}
+
+// WriteText writes the changes as the plan of a dry run, after the two runs compared.
+func (d *RunDiff) WriteText(w io.Writer) {
+	fmt.Fprintln(w, "Changes from run "+d.From.ID+" ("+d.From.At+") to run "+d.To.ID+" ("+d.To.At+")")
+	d.Plan.WriteText(w)
+}
+
+// runDiff prints the nodes and relationships added, removed and changed between the
+// end of two discovery runs:
+//
+//	graphcmdb diff [options] <runA> <runB>
+//
+// The snapshots are rebuilt by LoadGraphAsOf, so the properties of the relationships are
+// compared as well as the ones of the nodes, the removed ones included.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	server := flags.String("server", "", "only compare this server and the items directly attached to it")
+	labels := flags.String("label", "", "comma separated labels of the nodes to compare")
+	format := flags.String("format", "text", "output format: text or json")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || (*format != "text" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb diff [options] <runA> <runB>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	driver, err := neoOptions.NewDriver()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer driver.Close(ctx)
+
+	session := driver.NewSession(ctx, neoOptions.SessionConfig(neo4j.AccessModeRead))
+	defer session.Close(ctx)
+
+	var runs [2]DiffedRun
+	var graphs [2]*Graph
+	for i, id := range flags.Args() {
+		runs[i].ID = id
+		runs[i].At, err = loadRunEnd(session, ctx, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		graphs[i], err = LoadGraphAsOf(session, ctx, runs[i].At)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *server != "" {
+			graphs[i] = graphs[i].Neighborhood(nodeKey("Server", *server))
+		}
+	}
+
+	var selected []string
+	if *labels != "" {
+		selected = strings.Split(*labels, ",")
+	}
+	diff := NewRunDiff(runs[0], graphs[0], runs[1], graphs[1], selected)
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(diff)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	diff.WriteText(os.Stdout)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// snapshotGraph returns a graph like LoadGraphAsOf does, with nodes identified by
+// element ids that differ from one snapshot to the other.
+func snapshotGraph(prefix string, server map[string]any, running map[string]any, mount map[string]any) *Graph {
+	graph := NewGraph()
+	graph.AddNode(&Node{id: prefix + ":1", class: "Server", name: "web01", properties: server})
+	graph.AddNode(&Node{id: prefix + ":2", class: "Service", name: "nginx", properties: map[string]any{"name": "nginx"}})
+	graph.AddNode(&Node{id: prefix + ":3", class: "Storage", name: "/data", properties: map[string]any{"name": "/data"}})
+	graph.AddRelationship(&Relationship{left: graph.Node(prefix + ":1"), class: "RUNNING", right: graph.Node(prefix + ":2"), properties: running})
+	graph.AddRelationship(&Relationship{left: graph.Node(prefix + ":1"), class: "HAS_MOUNT", right: graph.Node(prefix + ":3"), properties: mount})
+
+	return graph
+}
+
+func TestNewRunDiff(t *testing.T) {
+	before := snapshotGraph("a",
+		map[string]any{"name": "web01", "os": "linux", "owner": "alice", "last_seen": "2024-01-01T00:00:00Z"},
+		map[string]any{"plugin": "services", "pid": "1", "port": "80", "active": true},
+		map[string]any{"plugin": "mounts", "active": true})
+	after := snapshotGraph("b",
+		map[string]any{"name": "web01", "os": "linux", "last_seen": "2024-02-01T00:00:00Z"},
+		map[string]any{"plugin": "services", "pid": "2", "active": true, "last_seen": "2024-02-01T00:00:00Z"},
+		map[string]any{"plugin": "mounts", "active": false})
+	server := PlannedEndpoint{Label: "Server", Name: "web01"}
+	running := PlannedRelationship{Action: "update", Type: "RUNNING", From: server, To: PlannedEndpoint{Label: "Service", Name: "nginx"},
+		Changes: map[string]PropertyChange{"pid": {Before: "1", After: "2"}, "port": {Before: "80"}}}
+	mount := PlannedRelationship{Action: "update", Type: "HAS_MOUNT", From: server, To: PlannedEndpoint{Label: "Storage", Name: "/data"},
+		Changes: map[string]PropertyChange{"active": {Before: true, After: false}}}
+
+	tests := []struct {
+		name              string
+		labels            []string
+		wantNodes         []PlannedNode
+		wantRelationships []PlannedRelationship
+	}{
+		{"all labels", nil, []PlannedNode{{Action: "update", Label: "Server", Name: "web01", Changes: map[string]PropertyChange{"owner": {Before: "alice"}}}}, []PlannedRelationship{mount, running}},
+		{"one label", []string{"Service"}, []PlannedNode{}, []PlannedRelationship{running}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := NewRunDiff(DiffedRun{ID: "a"}, before, DiffedRun{ID: "b"}, after, test.labels)
+			if !reflect.DeepEqual(diff.Nodes, test.wantNodes) {
+				t.Errorf("nodes %+v, want %+v", diff.Nodes, test.wantNodes)
+			}
+			if !reflect.DeepEqual(diff.Relationships, test.wantRelationships) {
+				t.Errorf("relationships %+v, want %+v", diff.Relationships, test.wantRelationships)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "time"
+
+// Kinds of ChangeEvent.
+const (
+	changeNodeCreated         = "node_created"
+	changeNodeUpdated         = "node_updated"
+	changeNodeDeleted         = "node_deleted"
+	changeRelationshipCreated = "relationship_created"
+	changeRelationshipUpdated = "relationship_updated"
+	changeRelationshipDeleted = "relationship_deleted"
+)
+
+// ChangeEvent is a change a Batch made to the graph: a node or a relationship created,
+// updated or deleted, with its properties before and after the change, the source that
+// queued it (a plugin, "discovery", an import mapping or manualSource) and the server
+// being discovered.
+type ChangeEvent struct {
+	Kind   string           `json:"kind"`
+	Source string           `json:"plugin,omitempty"`
+	Server string           `json:"server,omitempty"`
+	Label  string           `json:"label,omitempty"`
+	Name   string           `json:"name,omitempty"`
+	Type   string           `json:"type,omitempty"`
+	From   *PlannedEndpoint `json:"from,omitempty"`
+	To     *PlannedEndpoint `json:"to,omitempty"`
+	Before map[string]any   `json:"before,omitempty"`
+	After  map[string]any   `json:"after,omitempty"`
+	At     string           `json:"at"`
+	RunID  string           `json:"run_id,omitempty"`
+}
+
+func newChangeEvent(kind string) ChangeEvent {
+	return ChangeEvent{Kind: kind, At: formatTimestamp(time.Now())}
+}
+
+// nodeChangeEvent returns the change of node whose properties were before, nil when it
+// is created, and on which the written properties are set, nil when it is deleted.
+func nodeChangeEvent(kind string, node *Node, before map[string]any, written map[string]any) ChangeEvent {
+	event := newChangeEvent(kind)
+	event.Label = node.class
+	event.Name = node.name
+	event.Before = before
+	if written != nil {
+		event.After = mergeProperties(before, written)
+	}
+
+	return event
+}
+
+// relationshipChangeEvent returns the change of a relationship of type class, like
+// nodeChangeEvent.
+func relationshipChangeEvent(kind string, class string, leftLabel string, leftName string, rightLabel string, rightName string, before map[string]any, written map[string]any) ChangeEvent {
+	event := newChangeEvent(kind)
+	event.Type = class
+	event.From = &PlannedEndpoint{Label: leftLabel, Name: leftName}
+	event.To = &PlannedEndpoint{Label: rightLabel, Name: rightName}
+	event.Before = before
+	if written != nil {
+		event.After = mergeProperties(before, written)
+	}
+
+	return event
+}
+
+// relationshipDeletedEvent returns the deletion of the relationship of a Tombstone row.
+func relationshipDeletedEvent(row map[string]any, properties map[string]any) ChangeEvent {
+	return relationshipChangeEvent(changeRelationshipDeleted, row["type"].(string), row["left_label"].(string), row["left_name"].(string), row["right_label"].(string), row["right_name"].(string), properties, nil)
+}
+
+// mergeProperties returns a copy of properties with the written ones set, or removed
+// when nil.
+func mergeProperties(properties map[string]any, written map[string]any) map[string]any {
+	merged := copyProperties(properties)
+	for field, value := range written {
+		if value == nil {
+			delete(merged, field)
+		} else {
+			merged[field] = value
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// runExport dumps the CMDB, or the subgraph selected by the filters, for the teams
+// without access to the graph database:
+//
+//	graphcmdb export [options]
+//
+// The csv format writes nodes.csv and relationships.csv in the output directory, with
+// the headers expected by neo4j-admin database import.
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	format := flags.String("format", "json", "output format: graphml, dot, json or csv")
+	output := flags.String("o", "", "file to write instead of the standard output, or directory of the csv files")
+	labels := flags.String("label", "", "comma separated labels of the nodes to export")
+	server := flags.String("server", "", "only export this server and the items directly attached to it")
+	tag := flags.String("tag", "", "only export the nodes whose tags property holds this tag")
+	asOf := flags.String("as-of", "", "export the CMDB as it was at this date (neo4j backend only)")
+	flags.Parse(args)
+
+	writers := map[string]func(w io.Writer, graph *Graph) error{
+		"graphml": writeGraphML,
+		"dot":     writeDOT,
+		"json": func(w io.Writer, graph *Graph) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(graph)
+		},
+	}
+	if _, found := writers[*format]; flags.NArg() != 0 || (!found && *format != "csv") {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb export [options]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	var graph *Graph
+	if *asOf != "" {
+		at, err := parseTimestamp(*asOf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		driver, err := neoOptions.NewDriver()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer driver.Close(ctx)
+
+		session := driver.NewSession(ctx, neoOptions.SessionConfig(neo4j.AccessModeRead))
+		defer session.Close(ctx)
+
+		graph, err = LoadGraphAsOf(session, ctx, at)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		store, err := NewStore(ctx, neoOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close(ctx)
+
+		graph, err = store.Query(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *server != "" {
+		graph = graph.Neighborhood(nodeKey("Server", *server))
+	}
+	if *labels != "" {
+		selected := strings.Split(*labels, ",")
+		graph = graph.Filter(func(n *Node) bool { return isAllowed(n.class, selected) })
+	}
+	if *tag != "" {
+		graph = graph.Filter(func(n *Node) bool { return hasTag(n, *tag) })
+	}
+	graph.Sort()
+
+	if *format == "csv" {
+		err := writeNeo4jCSV(*output, graph)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	err := writers[*format](w, graph)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// hasTag reports whether the tags property of the node, a list or a comma separated
+// string, holds tag.
+func hasTag(n *Node, tag string) bool {
+	var tags []string
+	switch value := n.properties["tags"].(type) {
+	case string:
+		tags = strings.Split(value, ",")
+	case []any:
+		for _, item := range value {
+			tags = append(tags, fmt.Sprint(item))
+		}
+	case []string:
+		tags = value
+	}
+
+	for _, candidate := range tags {
+		if strings.TrimSpace(candidate) == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// writeGraphML writes the graph as GraphML, the label and type as "label" data, the node
+// name as "name" data and every property as string data.
+func writeGraphML(w io.Writer, graph *Graph) error {
+	doc := graphML{Xmlns: "http://graphml.graphdrawing.org/xmlns"}
+	doc.Graph.EdgeDefault = "directed"
+
+	keys := map[string]bool{}
+	addData := func(data []graphMLData, domain string, field string, value any) []graphMLData {
+		id := domain + "_" + field
+		if !keys[id] {
+			keys[id] = true
+			doc.Keys = append(doc.Keys, graphMLKey{ID: id, For: domain, Name: field, Type: "string"})
+		}
+		return append(data, graphMLData{Key: id, Value: fmt.Sprint(value)})
+	}
+
+	for _, n := range graph.nodes {
+		data := addData(nil, "node", "label", n.class)
+		data = addData(data, "node", "name", n.name)
+		for _, field := range sortedKeys(n.properties) {
+			if field == "name" {
+				continue
+			}
+			data = addData(data, "node", field, n.properties[field])
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: n.id, Data: data})
+	}
+	for _, r := range graph.relationships {
+		data := addData(nil, "edge", "label", r.class)
+		for _, field := range sortedKeys(r.properties) {
+			data = addData(data, "edge", field, r.properties[field])
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{Source: r.left.id, Target: r.right.id, Data: data})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+// writeDOT writes the graph for Graphviz, nodes labelled with their label and name and
+// edges with their type.
+func writeDOT(w io.Writer, graph *Graph) error {
+	lines := []string{"digraph cmdb {", "    node [shape=box];"}
+	for _, n := range graph.nodes {
+		lines = append(lines, "    "+dotQuote(n.id)+" [label="+dotQuote(n.class+"\n"+n.name)+"];")
+	}
+	for _, r := range graph.relationships {
+		lines = append(lines, "    "+dotQuote(r.left.id)+" -> "+dotQuote(r.right.id)+" [label="+dotQuote(r.class)+"];")
+	}
+	lines = append(lines, "}")
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+
+	return err
+}
+
+func dotQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// writeNeo4jCSV writes nodes.csv and relationships.csv in dir for neo4j-admin database
+// import. Property types are declared in the headers: long, double, boolean, string
+// or, for lists, string[] joined by ";".
+func writeNeo4jCSV(dir string, graph *Graph) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	nodeProperties := make([]map[string]any, len(graph.nodes))
+	for i, n := range graph.nodes {
+		nodeProperties[i] = copyProperties(n.properties)
+		nodeProperties[i]["name"] = n.name
+	}
+	nodeFields, nodeHeader := csvColumns(nodeProperties)
+	nodeRows := [][]string{append([]string{"id:ID", ":LABEL"}, nodeHeader...)}
+	for i, n := range graph.nodes {
+		nodeRows = append(nodeRows, append([]string{n.id, n.class}, csvValues(nodeFields, nodeProperties[i])...))
+	}
+
+	relationshipProperties := make([]map[string]any, len(graph.relationships))
+	for i, r := range graph.relationships {
+		relationshipProperties[i] = r.properties
+	}
+	relationshipFields, relationshipHeader := csvColumns(relationshipProperties)
+	relationshipRows := [][]string{append([]string{":START_ID", ":END_ID", ":TYPE"}, relationshipHeader...)}
+	for _, r := range graph.relationships {
+		relationshipRows = append(relationshipRows, append([]string{r.left.id, r.right.id, r.class}, csvValues(relationshipFields, r.properties)...))
+	}
+
+	files := map[string][][]string{"nodes.csv": nodeRows, "relationships.csv": relationshipRows}
+	for _, fileName := range sortedKeys(files) {
+		rows := files[fileName]
+		f, err := os.Create(filepath.Join(dir, fileName))
+		if err != nil {
+			return err
+		}
+		writer := csv.NewWriter(f)
+		err = writer.WriteAll(rows)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		log.Println("Export " + filepath.Join(dir, fileName))
+	}
+
+	return nil
+}
+
+// csvColumns returns the sorted property names of entities and their typed headers.
+func csvColumns(entities []map[string]any) ([]string, []string) {
+	types := map[string]string{}
+	for _, properties := range entities {
+		for field, value := range properties {
+			valueType := csvType(value)
+			if previous, found := types[field]; found && previous != valueType {
+				switch {
+				case strings.HasSuffix(previous, "[]") || strings.HasSuffix(valueType, "[]"):
+					valueType = "string[]"
+				case (previous == "long" || previous == "double") && (valueType == "long" || valueType == "double"):
+					valueType = "double"
+				default:
+					valueType = "string"
+				}
+			}
+			types[field] = valueType
+		}
+	}
+
+	fields := sortedKeys(types)
+	header := make([]string, len(fields))
+	for i, field := range fields {
+		header[i] = field + ":" + types[field]
+	}
+
+	return fields, header
+}
+
+func csvType(value any) string {
+	switch value.(type) {
+	case int64, int:
+		return "long"
+	case float64:
+		return "double"
+	case bool:
+		return "boolean"
+	case []any, []string:
+		return "string[]"
+	}
+
+	return "string"
+}
+
+func csvValues(fields []string, properties map[string]any) []string {
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		switch value := properties[field].(type) {
+		case nil:
+		case []any:
+			items := make([]string, len(value))
+			for j, item := range value {
+				items[j] = fmt.Sprint(item)
+			}
+			values[i] = strings.Join(items, ";")
+		case []string:
+			values[i] = strings.Join(value, ";")
+		default:
+			values[i] = fmt.Sprint(value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteNeo4jCSV(t *testing.T) {
+	graph := testGraph([]*Node{
+		{class: "Server", name: "web01", properties: map[string]any{"cpus": int64(4), "load": 0.5, "virtual": true, "tags": []any{"web", "prod"}, "os": "linux, \"debian\""}},
+		{class: "Server", name: "web02", properties: map[string]any{"cpus": 2.5, "load": int64(1), "tags": "single"}},
+		{class: "Service", name: "nginx", properties: map[string]any{}},
+	}, [3]string{"Server/web01", "RUNNING", "Service/nginx"}, [3]string{"Server/web02", "RUNNING", "Service/nginx"})
+	graph.relationships[0].properties["pid"] = int64(42)
+	graph.relationships[1].properties["ports"] = []string{"80", "443"}
+
+	dir := t.TempDir()
+	if err := writeNeo4jCSV(dir, graph); err != nil {
+		t.Fatal(err)
+	}
+
+	for fileName, want := range map[string]string{
+		"nodes.csv": "id:ID,:LABEL,cpus:double,load:double,name:string,os:string,tags:string[],virtual:boolean\n" +
+			"Server/web01,Server,4,0.5,web01,\"linux, \"\"debian\"\"\",web;prod,true\n" +
+			"Server/web02,Server,2.5,1,web02,,single,\n" +
+			"Service/nginx,Service,,,nginx,,,\n",
+		"relationships.csv": ":START_ID,:END_ID,:TYPE,pid:long,ports:string[]\n" +
+			"Server/web01,Service/nginx,RUNNING,42,\n" +
+			"Server/web02,Service/nginx,RUNNING,,80;443\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s:\n%s\nwant\n%s", fileName, got, want)
+		}
+	}
+}
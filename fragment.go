@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// fragmentServerID is the node id a graph plugin uses to refer to the server being discovered.
+const fragmentServerID = "$server"
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// GraphFragment is the JSON document a "graph" plugin script prints: a set of nodes,
+// identified by their label and identity keys, and the relationships between them.
+type GraphFragment struct {
+	Nodes         []FragmentNode         `json:"nodes"`
+	Relationships []FragmentRelationship `json:"relationships"`
+}
+
+type FragmentNode struct {
+	ID         string         `json:"id"`
+	Label      string         `json:"label"`
+	Keys       map[string]any `json:"keys"`
+	Properties map[string]any `json:"properties"`
+}
+
+type FragmentRelationship struct {
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	Type       string         `json:"type"`
+	Properties map[string]any `json:"properties"`
+}
+
+func ParseGraphFragment(out string) (*GraphFragment, error) {
+	fragment := new(GraphFragment)
+	decoder := json.NewDecoder(strings.NewReader(out))
+	decoder.UseNumber()
+	if err := decoder.Decode(fragment); err != nil {
+		return nil, errors.New("invalid graph fragment: " + err.Error())
+	}
+
+	return fragment, nil
+}
+
+// Validate checks that every label, relationship type and property name is a plain
+// identifier, that node ids are unique and that relationships only reference declared
+// nodes (or the discovered server). When allowedLabels or allowedTypes are not empty,
+// labels and relationship types must also be listed there.
+func (f *GraphFragment) Validate(allowedLabels []string, allowedTypes []string) error {
+	ids := map[string]bool{fragmentServerID: true}
+	for _, node := range f.Nodes {
+		if node.ID == "" || ids[node.ID] {
+			return errors.New("node id '" + node.ID + "' is empty or duplicated")
+		}
+		ids[node.ID] = true
+
+		if !identifierRegexp.MatchString(node.Label) || !isAllowed(node.Label, allowedLabels) {
+			return errors.New("node " + node.ID + " has an invalid or not allowed label '" + node.Label + "'")
+		}
+		if len(node.Keys) == 0 {
+			return errors.New("node " + node.ID + " has no identity keys")
+		}
+		if err := validateFragmentProperties(node.ID, node.Keys); err != nil {
+			return err
+		}
+		if err := validateFragmentProperties(node.ID, node.Properties); err != nil {
+			return err
+		}
+	}
+
+	for _, rel := range f.Relationships {
+		if !ids[rel.From] || !ids[rel.To] {
+			return errors.New("relationship " + rel.From + "->" + rel.To + " references an unknown node")
+		}
+		if !identifierRegexp.MatchString(rel.Type) || !isAllowed(rel.Type, allowedTypes) {
+			return errors.New("relationship " + rel.From + "->" + rel.To + " has an invalid or not allowed type '" + rel.Type + "'")
+		}
+		if err := validateFragmentProperties(rel.From+"->"+rel.To, rel.Properties); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateFragmentProperties(owner string, properties map[string]any) error {
+	for field, value := range properties {
+		if !identifierRegexp.MatchString(field) {
+			return errors.New(owner + " has an invalid property name '" + field + "'")
+		}
+		converted, ok := fragmentValue(value)
+		if !ok {
+			return errors.New(owner + " property " + field + " is not a scalar or a list of scalars")
+		}
+		properties[field] = converted
+	}
+
+	return nil
+}
+
+// fragmentValue converts a decoded JSON value to a type Neo4j can store as a property.
+func fragmentValue(value any) (any, bool) {
+	switch v := value.(type) {
+	case string, bool:
+		return v, true
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		f, err := v.Float64()
+		return f, err == nil
+	case []any:
+		list := make([]any, 0, len(v))
+		for _, item := range v {
+			converted, ok := fragmentValue(item)
+			if !ok {
+				return nil, false
+			}
+			if _, nested := converted.([]any); nested {
+				return nil, false
+			}
+			list = append(list, converted)
+		}
+		return list, true
+	}
+
+	return nil, false
+}
+
+func isAllowed(name string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddTo queues every node and relationship of the fragment in the batch of the server,
+// so a server's fragment is either stored completely or not at all. Relationships are
+// stamped with the plugin and server that reported them.
+func (f *GraphFragment) AddTo(batch *Batch, server *Node, plugin string) error {
+	nodes := map[string]*Node{fragmentServerID: server}
+	for _, node := range f.Nodes {
+		properties := map[string]any{}
+		for k, v := range node.Properties {
+			properties[k] = v
+		}
+
+		nodes[node.ID] = &Node{class: node.Label, name: fragmentNodeName(node), keys: node.Keys, properties: properties}
+		err := batch.UpsertNode(nodes[node.ID], true, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rel := range f.Relationships {
+		properties := map[string]any{}
+		for k, v := range rel.Properties {
+			properties[k] = v
+		}
+		properties["plugin"] = plugin
+		properties["server"] = server.name
+
+		err := batch.UpsertRelationship(&Relationship{left: nodes[rel.From], class: rel.Type, right: nodes[rel.To], properties: properties}, relationUpdate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fragmentNodeName derives a display name from the identity keys of a node that
+// does not set one.
+func fragmentNodeName(node FragmentNode) string {
+	if name, found := node.Keys["name"]; found {
+		if s, ok := name.(string); ok {
+			return s
+		}
+	}
+
+	parts := []string{}
+	for _, field := range sortedKeys(node.Keys) {
+		parts = append(parts, fmt.Sprint(node.Keys[field]))
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphFragmentValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		fragment      string
+		allowedLabels []string
+		allowedTypes  []string
+		err           string
+	}{
+		{"valid", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "abc"}, "properties": {"image": "nginx", "ports": [80, 443], "cpus": 1.5, "privileged": false}}],
+			"relationships": [{"from": "$server", "to": "c1", "type": "HOSTS", "properties": {"since": "2024"}}]}`, nil, nil, ""},
+		{"allowed", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "abc"}}], "relationships": [{"from": "$server", "to": "c1", "type": "HOSTS"}]}`,
+			[]string{"Container"}, []string{"HOSTS"}, ""},
+		{"empty", `{}`, nil, nil, ""},
+		{"empty id", `{"nodes": [{"id": "", "label": "Container", "keys": {"id": "abc"}}]}`, nil, nil, "empty or duplicated"},
+		{"duplicated id", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}}, {"id": "c1", "label": "Container", "keys": {"id": "b"}}]}`, nil, nil, "empty or duplicated"},
+		{"server id", `{"nodes": [{"id": "$server", "label": "Container", "keys": {"id": "a"}}]}`, nil, nil, "empty or duplicated"},
+		{"invalid label", `{"nodes": [{"id": "c1", "label": "Container) DETACH DELETE (n", "keys": {"id": "a"}}]}`, nil, nil, "invalid or not allowed label"},
+		{"label not allowed", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}}]}`, []string{"Service"}, nil, "invalid or not allowed label"},
+		{"no keys", `{"nodes": [{"id": "c1", "label": "Container"}]}`, nil, nil, "no identity keys"},
+		{"invalid key", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"a b": "x"}}]}`, nil, nil, "invalid property name"},
+		{"invalid property", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}, "properties": {"x-y": 1}}]}`, nil, nil, "invalid property name"},
+		{"object property", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}, "properties": {"labels": {"a": 1}}}]}`, nil, nil, "not a scalar"},
+		{"nested list", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}, "properties": {"ports": [[80]]}}]}`, nil, nil, "not a scalar"},
+		{"null property", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}, "properties": {"image": null}}]}`, nil, nil, "not a scalar"},
+		{"unknown node", `{"relationships": [{"from": "$server", "to": "c2", "type": "HOSTS"}]}`, nil, nil, "unknown node"},
+		{"invalid type", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}}], "relationships": [{"from": "$server", "to": "c1", "type": "HOSTS]->()"}]}`, nil, nil, "invalid or not allowed type"},
+		{"type not allowed", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}}], "relationships": [{"from": "$server", "to": "c1", "type": "HOSTS"}]}`, nil, []string{"RUNNING"}, "invalid or not allowed type"},
+		{"invalid relationship property", `{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": "a"}}], "relationships": [{"from": "$server", "to": "c1", "type": "HOSTS", "properties": {"a.b": 1}}]}`, nil, nil, "invalid property name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fragment, err := ParseGraphFragment(test.fragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fragment.Validate(test.allowedLabels, test.allowedTypes)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestGraphFragmentValidateConvertsNumbers(t *testing.T) {
+	fragment, err := ParseGraphFragment(`{"nodes": [{"id": "c1", "label": "Container", "keys": {"id": 7}, "properties": {"cpus": 1.5, "ports": [80, 8.5]}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fragment.Validate(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	node := fragment.Nodes[0]
+	if node.Keys["id"] != int64(7) || node.Properties["cpus"] != 1.5 {
+		t.Errorf("numbers not converted: %#v %#v", node.Keys, node.Properties)
+	}
+	if ports := node.Properties["ports"].([]any); ports[0] != int64(80) || ports[1] != 8.5 {
+		t.Errorf("list numbers not converted: %#v", ports)
+	}
+}
@@ -3,6 +3,7 @@ module padovini/BuildCMDB
 go 1.19
 
 require (
+	github.com/graphql-go/graphql v0.8.1
 	github.com/neo4j/neo4j-go-driver/v5 v5.5.0
 	github.com/pkg/sftp v1.13.5
 	github.com/segmentio/ksuid v1.0.4
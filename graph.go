@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// bookkeepingLabels and bookkeepingTypes record how the CMDB evolved rather than
+// configuration items: they are never aged by prune nor part of graph snapshots.
+var bookkeepingLabels = []string{"DiscoveryRun", "Change", "Tombstone", "SchemaMigration"}
+var bookkeepingTypes = []string{"COVERED", "HAS_CHANGE", "HAS_RELATIONSHIP_CHANGE"}
+
+// isBookkeeping reports whether name is a bookkeeping label or relationship type.
+func isBookkeeping(name string) bool {
+	for _, bookkeeping := range append(bookkeepingLabels, bookkeepingTypes...) {
+		if name == bookkeeping {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Graph is a snapshot of configuration items and of the relationships between them,
+// loaded in memory for reports and exports.
+type Graph struct {
+	nodes         []*Node
+	relationships []*Relationship
+	index         map[string]*Node
+}
+
+func NewGraph() *Graph {
+	return &Graph{index: map[string]*Node{}}
+}
+
+// nodeKey identifies a node by label and name, the way plugins and tombstones refer to it.
+func nodeKey(label string, name string) string {
+	return label + "/" + name
+}
+
+func (g *Graph) AddNode(n *Node) {
+	if n.id == "" {
+		n.id = nodeKey(n.class, n.name)
+	}
+	g.nodes = append(g.nodes, n)
+	g.index[n.id] = n
+	if _, found := g.index[nodeKey(n.class, n.name)]; !found {
+		g.index[nodeKey(n.class, n.name)] = n
+	}
+}
+
+// Node returns the node with the given id or "label/name" key.
+func (g *Graph) Node(key string) *Node {
+	return g.index[key]
+}
+
+func (g *Graph) AddRelationship(r *Relationship) {
+	g.relationships = append(g.relationships, r)
+}
+
+// Neighborhood returns the subgraph made of the node with the given key and of the
+// nodes and relationships directly attached to it.
+func (g *Graph) Neighborhood(key string) *Graph {
+	sub := NewGraph()
+	center := g.Node(key)
+	if center == nil {
+		return sub
+	}
+
+	sub.AddNode(center)
+	for _, r := range g.relationships {
+		var other *Node
+		if r.left == center {
+			other = r.right
+		} else if r.right == center {
+			other = r.left
+		} else {
+			continue
+		}
+		if sub.Node(other.id) == nil {
+			sub.AddNode(other)
+		}
+		sub.AddRelationship(r)
+	}
+
+	return sub
+}
+
+// Filter returns the subgraph made of the nodes for which keep returns true and of the
+// relationships between them.
+func (g *Graph) Filter(keep func(n *Node) bool) *Graph {
+	sub := NewGraph()
+	for _, n := range g.nodes {
+		if keep(n) {
+			sub.AddNode(n)
+		}
+	}
+	for _, r := range g.relationships {
+		if sub.Node(r.left.id) == r.left && sub.Node(r.right.id) == r.right {
+			sub.AddRelationship(r)
+		}
+	}
+
+	return sub
+}
+
+// Clone returns a copy of the graph whose nodes and relationships can be changed
+// without changing g.
+func (g *Graph) Clone() *Graph {
+	clone := NewGraph()
+	nodes := map[*Node]*Node{}
+	for _, n := range g.nodes {
+		copied := &Node{id: n.id, class: n.class, name: n.name, properties: copyProperties(n.properties)}
+		nodes[n] = copied
+		clone.AddNode(copied)
+	}
+	for _, r := range g.relationships {
+		clone.AddRelationship(&Relationship{left: nodes[r.left], class: r.class, right: nodes[r.right], properties: copyProperties(r.properties)})
+	}
+
+	return clone
+}
+
+func copyProperties(properties map[string]any) map[string]any {
+	copied := make(map[string]any, len(properties))
+	for k, v := range properties {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+// Sort orders nodes by label and name and relationships by type and endpoints, so
+// reports and exports are stable.
+func (g *Graph) Sort() {
+	sort.SliceStable(g.nodes, func(i, j int) bool {
+		if g.nodes[i].class != g.nodes[j].class {
+			return g.nodes[i].class < g.nodes[j].class
+		}
+		return g.nodes[i].name < g.nodes[j].name
+	})
+	sort.SliceStable(g.relationships, func(i, j int) bool {
+		a, b := g.relationships[i], g.relationships[j]
+		if a.class != b.class {
+			return a.class < b.class
+		}
+		if a.left.name != b.left.name {
+			return a.left.name < b.left.name
+		}
+		return a.right.name < b.right.name
+	})
+}
+
+type jsonNode struct {
+	ID         string         `json:"id"`
+	Label      string         `json:"label"`
+	Name       string         `json:"name"`
+	Properties map[string]any `json:"properties"`
+}
+
+type jsonRelationship struct {
+	Type       string         `json:"type"`
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	Properties map[string]any `json:"properties"`
+}
+
+type jsonGraph struct {
+	Nodes         []jsonNode         `json:"nodes"`
+	Relationships []jsonRelationship `json:"relationships"`
+}
+
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	out := jsonGraph{Nodes: []jsonNode{}, Relationships: []jsonRelationship{}}
+	for _, n := range g.nodes {
+		out.Nodes = append(out.Nodes, jsonNode{ID: n.id, Label: n.class, Name: n.name, Properties: n.properties})
+	}
+	for _, r := range g.relationships {
+		out.Relationships = append(out.Relationships, jsonRelationship{Type: r.class, From: r.left.id, To: r.right.id, Properties: r.properties})
+	}
+
+	return json.Marshal(out)
+}
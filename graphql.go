@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// graphqlModel lists the labels and, by relationship type, the labels found at its left
+// and right ends: the labels and relationships created by the discovery itself and the
+// ones declared by the plugins.
+type graphqlModel struct {
+	labels map[string]bool
+	left   map[string]map[string]bool
+	right  map[string]map[string]bool
+}
+
+// graphqlReservedNames are the type names of the schema that no label can take.
+var graphqlReservedNames = map[string]bool{"Query": true, "Node": true, "Edge": true, "JSON": true, "OtherNode": true}
+
+func newGraphQLModel(plugins []*Plugin) *graphqlModel {
+	model := &graphqlModel{labels: map[string]bool{}, left: map[string]map[string]bool{}, right: map[string]map[string]bool{}}
+	model.addRelationship("Server", "HAS_MOUNT", "Storage")
+	model.addRelationship("Server", "RUNNING", "Service")
+	model.addRelationship("Server", "CONNECTED", "Server")
+
+	for _, p := range plugins {
+		for label := range p.IdentityKeys() {
+			model.addLabel(label)
+		}
+		switch {
+		case p.kind == "relation":
+			model.addRelationship(p.config.GetString("left_node"), p.config.GetString("rel_name"), p.config.GetString("right_node"))
+		case p.kind == "graph":
+			// The nodes of a fragment can be linked to each other and to the server in
+			// either direction.
+			labels := append([]string{"Server"}, p.config.GetStringSlice("allowed_labels")...)
+			for _, class := range p.config.GetStringSlice("allowed_relationships") {
+				for _, left := range labels {
+					for _, right := range labels {
+						model.addRelationship(left, class, right)
+					}
+				}
+			}
+		case p.isServiceCheck():
+			model.addRelationship("Server", p.config.GetString("script.relation"), p.kind)
+		}
+	}
+
+	return model
+}
+
+func (m *graphqlModel) addLabel(label string) bool {
+	if !identifierRegexp.MatchString(label) || strings.HasPrefix(label, "__") || isBookkeeping(label) {
+		return false
+	}
+	if graphqlReservedNames[label] {
+		log.Println("Skip label " + label + ", reserved by the GraphQL schema")
+		return false
+	}
+	m.labels[label] = true
+
+	return true
+}
+
+func (m *graphqlModel) addRelationship(left string, class string, right string) {
+	if !identifierRegexp.MatchString(class) || !m.addLabel(left) || !m.addLabel(right) {
+		return
+	}
+	if m.left[class] == nil {
+		m.left[class] = map[string]bool{}
+		m.right[class] = map[string]bool{}
+	}
+	m.left[class][left] = true
+	m.right[class][right] = true
+}
+
+// graphqlRoot is the graph a GraphQL request is resolved against, with the
+// relationships of every node.
+type graphqlRoot struct {
+	graph    *Graph
+	adjacent map[*Node][]*Relationship
+}
+
+// graphqlEdge is a relationship seen from one of its ends, node being the other end.
+type graphqlEdge struct {
+	relationship *Relationship
+	direction    string
+	node         *Node
+}
+
+func newGraphQLRoot(graph *Graph) *graphqlRoot {
+	root := &graphqlRoot{graph: graph, adjacent: map[*Node][]*Relationship{}}
+	for _, r := range graph.relationships {
+		root.adjacent[r.left] = append(root.adjacent[r.left], r)
+		if r.right != r.left {
+			root.adjacent[r.right] = append(root.adjacent[r.right], r)
+		}
+	}
+
+	return root
+}
+
+func graphqlRootOf(p graphql.ResolveParams) *graphqlRoot {
+	values, _ := p.Info.RootValue.(map[string]any)
+	root, _ := values["root"].(*graphqlRoot)
+
+	return root
+}
+
+// edges returns the relationships of node of type class, or of every type when class is
+// empty, in direction, "in", "out" or "" for both, to a node of label unless empty.
+func (root *graphqlRoot) edges(node *Node, class string, direction string, label string) []graphqlEdge {
+	edges := []graphqlEdge{}
+	for _, r := range root.adjacent[node] {
+		if class != "" && r.class != class {
+			continue
+		}
+		if r.left == node && direction != "in" && (label == "" || r.right.class == label) {
+			edges = append(edges, graphqlEdge{relationship: r, direction: "out", node: r.right})
+		}
+		if r.right == node && direction != "out" && (label == "" || r.left.class == label) {
+			edges = append(edges, graphqlEdge{relationship: r, direction: "in", node: r.left})
+		}
+	}
+
+	return edges
+}
+
+// graphqlJSON is the scalar of the properties, serialized as a JSON object.
+var graphqlJSON = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "A JSON value, the properties of an item or of a relationship.",
+	Serialize:   func(value any) any { return value },
+	ParseValue:  func(value any) any { return value },
+	ParseLiteral: func(value ast.Value) any {
+		if value, ok := value.(*ast.StringValue); ok {
+			return value.Value
+		}
+		return nil
+	},
+})
+
+// NewGraphQLSchema generates the GraphQL schema of the CMDB model: one object type per
+// known label, implementing the Node interface, with an out_TYPE and in_TYPE field per
+// relationship type leaving or reaching the label. The items of the other labels are
+// OtherNode objects, and the relationships of any type can be queried through the
+// relationships field of every node.
+func NewGraphQLSchema(plugins []*Plugin) (graphql.Schema, error) {
+	model := newGraphQLModel(plugins)
+
+	var nodeInterface *graphql.Interface
+	edgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Edge",
+		Description: "A relationship of an item, to or from another item.",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"type": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(graphqlEdge).relationship.class, nil
+				}},
+				"direction": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "out from the item, in to the item", Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(graphqlEdge).direction, nil
+				}},
+				"properties": &graphql.Field{Type: graphqlJSON, Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(graphqlEdge).relationship.properties, nil
+				}},
+				"node": &graphql.Field{Type: graphql.NewNonNull(nodeInterface), Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(graphqlEdge).node, nil
+				}},
+			}
+		}),
+	})
+
+	nodeFields := func() graphql.Fields {
+		return graphql.Fields{
+			"label": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (any, error) {
+				return p.Source.(*Node).class, nil
+			}},
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (any, error) {
+				return p.Source.(*Node).name, nil
+			}},
+			"properties": &graphql.Field{Type: graphqlJSON, Resolve: func(p graphql.ResolveParams) (any, error) {
+				return newAPINode(p.Source.(*Node)).Properties, nil
+			}},
+			"sources": &graphql.Field{Type: graphqlJSON, Description: "the source of every property", Resolve: func(p graphql.ResolveParams) (any, error) {
+				return propertySources(p.Source.(*Node).properties), nil
+			}},
+			"relationships": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edgeType))),
+				Args: graphql.FieldConfigArgument{
+					"type":      &graphql.ArgumentConfig{Type: graphql.String},
+					"direction": &graphql.ArgumentConfig{Type: graphql.String, Description: "in, out or both"},
+					"label":     &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					class, _ := p.Args["type"].(string)
+					direction, _ := p.Args["direction"].(string)
+					label, _ := p.Args["label"].(string)
+					if direction == "both" {
+						direction = ""
+					}
+					if direction != "" && direction != "in" && direction != "out" {
+						return nil, errors.New("invalid direction " + direction + ", expected in, out or both")
+					}
+					return graphqlRootOf(p).edges(p.Source.(*Node), class, direction, label), nil
+				},
+			},
+		}
+	}
+
+	types := map[string]*graphql.Object{}
+	nodeInterface = graphql.NewInterface(graphql.InterfaceConfig{
+		Name:        "Node",
+		Description: "A configuration item.",
+		Fields:      nodeFields(),
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			if object, found := types[p.Value.(*Node).class]; found {
+				return object
+			}
+			return types["OtherNode"]
+		},
+	})
+
+	types["OtherNode"] = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "OtherNode",
+		Description: "A configuration item whose label is not declared by the discovery or the plugins.",
+		Interfaces:  []*graphql.Interface{nodeInterface},
+		Fields:      nodeFields(),
+	})
+	for _, label := range sortedKeys(model.labels) {
+		fields := nodeFields()
+		for _, class := range sortedKeys(model.left) {
+			for direction, labels := range map[string]map[string]bool{"out": model.left[class], "in": model.right[class]} {
+				if !labels[label] {
+					continue
+				}
+				class, direction := class, direction
+				fields[direction+"_"+class] = &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edgeType))),
+					Description: "the " + class + " relationships " + map[string]string{"out": "from", "in": "to"}[direction] + " the item",
+					Args:        graphql.FieldConfigArgument{"label": &graphql.ArgumentConfig{Type: graphql.String}},
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						label, _ := p.Args["label"].(string)
+						return graphqlRootOf(p).edges(p.Source.(*Node), class, direction, label), nil
+					},
+				}
+			}
+		}
+		types[label] = graphql.NewObject(graphql.ObjectConfig{Name: label, Interfaces: []*graphql.Interface{nodeInterface}, Fields: fields})
+	}
+
+	pageArgs := graphql.FieldConfigArgument{
+		"q":      &graphql.ArgumentConfig{Type: graphql.String, Description: "part of the name, case insensitive"},
+		"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+		"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 50, Description: "at most 500"},
+	}
+	nodesArgs := graphql.FieldConfigArgument{"label": &graphql.ArgumentConfig{Type: graphql.String}}
+	for name, arg := range pageArgs {
+		nodesArgs[name] = arg
+	}
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"node": &graphql.Field{
+				Type: nodeInterface,
+				Args: graphql.FieldConfigArgument{
+					"label": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"name":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if node := graphqlRootOf(p).graph.Node(nodeKey(p.Args["label"].(string), p.Args["name"].(string))); node != nil {
+						return node, nil
+					}
+					return nil, nil
+				},
+			},
+			"nodes": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(nodeInterface))),
+				Args: nodesArgs,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					label, _ := p.Args["label"].(string)
+					query, _ := p.Args["q"].(string)
+					var nodes []*Node
+					for _, node := range graphqlRootOf(p).graph.nodes {
+						if (label == "" || node.class == label) && strings.Contains(strings.ToLower(node.name), strings.ToLower(query)) {
+							nodes = append(nodes, node)
+						}
+					}
+					return graphqlPage(nodes, p.Args)
+				},
+			},
+			"servers": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(types["Server"]))),
+				Description: "the servers whose name or ip contains q",
+				Args:        pageArgs,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					query, _ := p.Args["q"].(string)
+					return graphqlPage(searchServers(graphqlRootOf(p).graph, query), p.Args)
+				},
+			},
+		},
+	})
+
+	var objects []graphql.Type
+	for _, label := range sortedKeys(types) {
+		objects = append(objects, types[label])
+	}
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Types: objects})
+}
+
+// graphqlPage returns the nodes of the page selected by the offset and limit arguments.
+func graphqlPage(nodes []*Node, args map[string]any) ([]*Node, error) {
+	offset, _ := args["offset"].(int)
+	limit, _ := args["limit"].(int)
+	if offset < 0 {
+		return nil, errors.New("invalid offset")
+	}
+	if limit < 1 || limit > 500 {
+		return nil, errors.New("invalid limit, expected 1 to 500")
+	}
+	if offset > len(nodes) {
+		offset = len(nodes)
+	}
+	if offset+limit < len(nodes) {
+		nodes = nodes[:offset+limit]
+	}
+
+	return append([]*Node{}, nodes[offset:]...), nil
+}
+
+// handleGraphQL resolves a GraphQL query against the graph:
+//
+//	POST /graphql {"query": "...", "variables": {...}, "operationName": "..."}
+//	GET /graphql?query=...&variables=...&operationName=...
+func (s *apiServer) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.authorize(w, r, false) {
+		return
+	}
+
+	var request struct {
+		Query         string         `json:"query"`
+		Variables     map[string]any `json:"variables"`
+		OperationName string         `json:"operationName"`
+	}
+	if r.Method == http.MethodGet {
+		request.Query = r.URL.Query().Get("query")
+		request.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid variables: "+err.Error())
+				return
+			}
+		}
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if request.Query == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing query")
+		return
+	}
+
+	graph := s.currentGraph(w, r)
+	if graph == nil {
+		return
+	}
+	result := graphql.Do(graphql.Params{
+		Schema:         s.schema,
+		RequestString:  request.Query,
+		RootObject:     map[string]any{"root": newGraphQLRoot(graph)},
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        r.Context(),
+	})
+	writeAPIJSON(w, http.StatusOK, result)
+}
+
+// graphqlLabels returns the labels of the object types of schema, for the startup log.
+func graphqlLabels(schema graphql.Schema) []string {
+	var labels []string
+	for name, t := range schema.TypeMap() {
+		if object, ok := t.(*graphql.Object); ok && !strings.HasPrefix(name, "__") && name != "Query" && name != "Edge" {
+			labels = append(labels, object.Name())
+		}
+	}
+	sort.Strings(labels)
+
+	return labels
+}
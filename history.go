@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// historyIgnoredProperties change on every discovery and are not recorded in the history.
+var historyIgnoredProperties = map[string]bool{
+	"first_seen":  true,
+	"last_seen":   true,
+	"last_run_id": true,
+	"stale":       true,
+	"stale_since": true,
+
+	propertySourcesField: true,
+}
+
+// PropertyChange is the previous and new value of a property changed by an update.
+type PropertyChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// diffProperties returns the properties whose value in after differs from before.
+// Properties missing from after are left untouched by updates and are not compared.
+func diffProperties(before map[string]any, after map[string]any) map[string]PropertyChange {
+	changes := map[string]PropertyChange{}
+	for field, value := range after {
+		if historyIgnoredProperties[field] {
+			continue
+		}
+		previous, found := before[field]
+		if found && fmt.Sprint(previous) == fmt.Sprint(value) {
+			continue
+		}
+		changes[field] = PropertyChange{Before: previous, After: value}
+	}
+
+	return changes
+}
+
+// diffSnapshots returns the properties that differ between two snapshots of the same
+// entity: the ones diffProperties reports, and the ones missing from after, whose
+// After is nil.
+func diffSnapshots(before map[string]any, after map[string]any) map[string]PropertyChange {
+	changes := diffProperties(before, after)
+	for field, value := range before {
+		if _, found := after[field]; !found && !historyIgnoredProperties[field] {
+			changes[field] = PropertyChange{Before: value}
+		}
+	}
+
+	return changes
+}
+
+// changeRow compares the current properties of the node with element id with the
+// properties about to be set and returns the Change node holding the previous and new
+// values, stamped with the id of the discovery run making the change if any, or nil
+// when nothing changes. It must run in the update transaction, before the properties
+// are set.
+func changeRow(id any, before map[string]any, properties map[string]any, runID string) (map[string]any, error) {
+	changes := diffProperties(before, properties)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+
+	row := map[string]any{
+		"id":         id,
+		"changed_at": formatTimestamp(time.Now()),
+		"run_id":     runID,
+		"changes":    string(encoded),
+		"properties": sortedKeys(changes),
+	}
+
+	return row, nil
+}
+
+// createChanges links every Change returned by changeRow to its node, numbering it
+// after the previous changes of the node.
+func createChanges(ctx context.Context, tx cypherTx, changes []map[string]any) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	_, err := tx.Run(ctx, "UNWIND $changes as row MATCH (a) WHERE "+tx.ID("a")+" = row.id OPTIONAL MATCH (a)-[:HAS_CHANGE]->(p:Change) WITH a, row, count(p) + 1 as version "+
+		"CREATE (a)-[:HAS_CHANGE]->(c:Change {name: a.name + ' v' + toString(version), version: version, changed_at: row.changed_at, run_id: row.run_id, properties: row.properties, changes: row.changes})", map[string]any{"changes": changes})
+
+	return err
+}
+
+// relationshipChangeRow returns the Change of the relationship of type class with
+// element id, from the node with element id leftID, like changeRow.
+func relationshipChangeRow(id any, leftID any, class string, before map[string]any, properties map[string]any, runID string) (map[string]any, error) {
+	row, err := changeRow(id, before, properties, runID)
+	if row != nil {
+		row["left"] = leftID
+		row["type"] = class
+	}
+
+	return row, err
+}
+
+// createRelationshipChanges links every Change returned by changeRow for a relationship
+// by relationshipChangeRow to the left node of the relationship. The Change keeps the id of the relationship until it
+// is deleted and its changes are moved to its Tombstone.
+func createRelationshipChanges(ctx context.Context, tx cypherTx, changes []map[string]any) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	_, err := tx.Run(ctx, "UNWIND $changes as row MATCH (a) WHERE "+tx.ID("a")+" = row.left "+
+		"CREATE (a)-[:HAS_RELATIONSHIP_CHANGE]->(c:Change {name: a.name + ' ' + row.type + ' ' + row.changed_at, relationship: row.id, changed_at: row.changed_at, run_id: row.run_id, properties: row.properties, changes: row.changes})", map[string]any{"changes": changes})
+
+	return err
+}
+
+// runHistory prints the timeline of the property changes of a configuration item:
+//
+//	graphcmdb history [options] <label> <name> [field=value...]
+//
+// The field=value arguments select the item by its other identity keys when several
+// items of the label share the name.
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() < 2 || !identifierRegexp.MatchString(flags.Arg(0)) {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb history [options] <label> <name> [field=value...]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	label := flags.Arg(0)
+	name := flags.Arg(1)
+	match := "MATCH (a:" + label + " {name: $name})"
+	params := map[string]any{"name": name}
+	for index, assignment := range flags.Args()[2:] {
+		field, value, found := strings.Cut(assignment, "=")
+		if !found || !identifierRegexp.MatchString(field) {
+			log.Fatal("Expected field=value, got " + assignment)
+		}
+		if index == 0 {
+			match += " WHERE "
+		} else {
+			match += " AND "
+		}
+		parameter := "key" + strconv.Itoa(index)
+		match += "toString(a." + field + ") = $" + parameter
+		params[parameter] = value
+	}
+
+	driver, err := neoOptions.NewDriver()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer driver.Close(ctx)
+
+	session := driver.NewSession(ctx, neoOptions.SessionConfig(neo4j.AccessModeRead))
+	defer session.Close(ctx)
+
+	records, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		result, err := tx.Run(ctx, match+" OPTIONAL MATCH (a)-[:HAS_CHANGE]->(c:Change) "+
+			"RETURN elementId(a) as id, a.first_seen as first_seen, c.version as version, c.changed_at as changed_at, c.run_id as run_id, c.changes as changes ORDER BY c.version", params)
+		if err != nil {
+			return nil, err
+		}
+
+		return result.Collect(ctx)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(records.([]*neo4j.Record)) == 0 {
+		log.Fatal(label + " " + name + " not found")
+	}
+	ids := map[string]bool{}
+	for _, record := range records.([]*neo4j.Record) {
+		ids[recordString(record, "id")] = true
+	}
+	if len(ids) > 1 {
+		log.Fatal(strconv.Itoa(len(ids)) + " " + label + " items are named " + name + ", select one with field=value arguments matching its identity keys")
+	}
+
+	for index, record := range records.([]*neo4j.Record) {
+		if index == 0 {
+			fmt.Println(recordString(record, "first_seen") + " first seen")
+		}
+		if recordString(record, "version") == "" {
+			continue
+		}
+
+		var changes map[string]PropertyChange
+		err := json.Unmarshal([]byte(recordString(record, "changes")), &changes)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(recordString(record, "changed_at") + " v" + recordString(record, "version") + " (run " + recordString(record, "run_id") + ")")
+		for _, field := range sortedKeys(changes) {
+			fmt.Println("    " + field + ": " + formatHistoryValue(changes[field].Before) + " -> " + formatHistoryValue(changes[field].After))
+		}
+	}
+}
+
+func formatHistoryValue(value any) string {
+	if value == nil {
+		return "(none)"
+	}
+
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultImpactTraversal follows, for every relationship type, the configuration items
+// that depend on the other end: the servers mounting a storage, the services running on
+// a server and the servers connecting to a server.
+const defaultImpactTraversal = "HAS_MOUNT:in,RUNNING:out,CONNECTED:in"
+
+// Impact lists the configuration items affected by the failure of a node, by label.
+type Impact struct {
+	Label    string                    `json:"label"`
+	Name     string                    `json:"name"`
+	Depth    int                       `json:"depth"`
+	Affected map[string][]ImpactedNode `json:"affected"`
+}
+
+// ImpactedNode is an affected item. Depth is its distance from the failing node in
+// relationships traversed, Via the type of the last one and Path the items, from the
+// failing node, followed to reach it.
+type ImpactedNode struct {
+	Name  string   `json:"name"`
+	Depth int      `json:"depth"`
+	Via   string   `json:"via"`
+	Path  []string `json:"path"`
+}
+
+// parseImpactTraversal parses "TYPE:direction,..." where direction is in, out or both,
+// the relationships to follow from the node of their right end, left end or either.
+func parseImpactTraversal(value string) (map[string]string, error) {
+	traversal := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		class, direction, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if !identifierRegexp.MatchString(class) || (direction != "in" && direction != "out" && direction != "both") {
+			return nil, errors.New("invalid traversal " + item + ", expected TYPE:in, TYPE:out or TYPE:both")
+		}
+		traversal[class] = direction
+	}
+
+	return traversal, nil
+}
+
+// NewImpact walks the graph from start, following the relationships of traversal in
+// their direction up to depth relationships away, or without limit when depth is 0.
+// Inactive relationships are not followed.
+func NewImpact(graph *Graph, start *Node, traversal map[string]string, depth int) *Impact {
+	impact := &Impact{Label: start.class, Name: start.name, Depth: depth, Affected: map[string][]ImpactedNode{}}
+
+	adjacent := map[*Node][]*Relationship{}
+	for _, r := range graph.relationships {
+		if r.properties["active"] == false {
+			continue
+		}
+		adjacent[r.left] = append(adjacent[r.left], r)
+		adjacent[r.right] = append(adjacent[r.right], r)
+	}
+
+	paths := map[*Node][]string{start: {start.class + " " + start.name}}
+	queue := []*Node{start}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if depth > 0 && len(paths[node]) > depth {
+			continue
+		}
+
+		for _, r := range adjacent[node] {
+			direction := traversal[r.class]
+			var next *Node
+			if r.right == node && (direction == "in" || direction == "both") {
+				next = r.left
+			} else if r.left == node && (direction == "out" || direction == "both") {
+				next = r.right
+			}
+			if next == nil || paths[next] != nil {
+				continue
+			}
+
+			paths[next] = append(append([]string{}, paths[node]...), next.class+" "+next.name)
+			queue = append(queue, next)
+			impact.Affected[next.class] = append(impact.Affected[next.class], ImpactedNode{
+				Name:  next.name,
+				Depth: len(paths[next]) - 1,
+				Via:   r.class,
+				Path:  paths[next],
+			})
+		}
+	}
+
+	for _, nodes := range impact.Affected {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			if nodes[i].Depth != nodes[j].Depth {
+				return nodes[i].Depth < nodes[j].Depth
+			}
+			return nodes[i].Name < nodes[j].Name
+		})
+	}
+
+	return impact
+}
+
+// Count returns the number of affected items.
+func (i *Impact) Count() int {
+	count := 0
+	for _, nodes := range i.Affected {
+		count += len(nodes)
+	}
+
+	return count
+}
+
+// WriteText writes the affected items grouped by label, each with the path reaching it.
+func (i *Impact) WriteText(w io.Writer) {
+	fmt.Fprintln(w, "Impact of "+i.Label+" "+i.Name+": "+strconv.Itoa(i.Count())+" affected items")
+	for _, label := range sortedKeys(i.Affected) {
+		fmt.Fprintln(w, "\n"+label+" ("+strconv.Itoa(len(i.Affected[label]))+")")
+		for _, node := range i.Affected[label] {
+			fmt.Fprintln(w, "    "+node.Name+"    "+strings.Join(node.Path, " > "))
+		}
+	}
+}
+
+// runImpact prints the configuration items affected by the failure of a node:
+//
+//	graphcmdb impact [options] <label> <name>
+func runImpact(args []string) {
+	flags := flag.NewFlagSet("impact", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	traverse := flags.String("traverse", defaultImpactTraversal, "relationships to follow and their direction, TYPE:in|out|both,...")
+	direction := flags.String("direction", "", "follow every relationship of -traverse in this direction instead: in, out or both")
+	depth := flags.Int("depth", 3, "maximum number of relationships from the node, 0 for no limit")
+	format := flags.String("format", "text", "output format: text or json")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || (*format != "text" && *format != "json") || *depth < 0 {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb impact [options] <label> <name>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	traversal, err := parseImpactTraversal(*traverse)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *direction != "" {
+		if *direction != "in" && *direction != "out" && *direction != "both" {
+			log.Fatal("Invalid direction " + *direction + ", expected in, out or both")
+		}
+		for class := range traversal {
+			traversal[class] = *direction
+		}
+	}
+
+	ctx := context.Background()
+	store, err := NewStore(ctx, neoOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	graph, err := store.Query(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := graph.Node(nodeKey(flags.Arg(0), flags.Arg(1)))
+	if start == nil {
+		log.Fatal("Unknown " + flags.Arg(0) + " " + flags.Arg(1))
+	}
+
+	impact := NewImpact(graph, start, traversal, *depth)
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(impact)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	impact.WriteText(os.Stdout)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewImpact(t *testing.T) {
+	graph := testGraph([]*Node{
+		{class: "Storage", name: "nas01:/export"},
+		{class: "Server", name: "web01"},
+		{class: "Server", name: "web02"},
+		{class: "Server", name: "lb01"},
+		{class: "Server", name: "backup01"},
+		{class: "Service", name: "nginx"},
+		{class: "Service", name: "haproxy"},
+	},
+		[3]string{"Server/web01", "HAS_MOUNT", "Storage/nas01:/export"},
+		[3]string{"Server/web02", "HAS_MOUNT", "Storage/nas01:/export"},
+		[3]string{"Server/backup01", "HAS_MOUNT", "Storage/nas01:/export"},
+		[3]string{"Server/web01", "RUNNING", "Service/nginx"},
+		[3]string{"Server/lb01", "CONNECTED", "Server/web01"},
+		[3]string{"Server/lb01", "RUNNING", "Service/haproxy"},
+		[3]string{"Server/web01", "CONNECTED", "Server/backup01"},
+	)
+	graph.relationships[2].properties["active"] = false
+	traversal, err := parseImpactTraversal(defaultImpactTraversal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		depth int
+		want  map[string][]ImpactedNode
+	}{
+		{"one relationship away", 1, map[string][]ImpactedNode{
+			"Server": {
+				{Name: "web01", Depth: 1, Via: "HAS_MOUNT", Path: []string{"Storage nas01:/export", "Server web01"}},
+				{Name: "web02", Depth: 1, Via: "HAS_MOUNT", Path: []string{"Storage nas01:/export", "Server web02"}},
+			},
+		}},
+		{"without limit", 0, map[string][]ImpactedNode{
+			"Server": {
+				{Name: "web01", Depth: 1, Via: "HAS_MOUNT", Path: []string{"Storage nas01:/export", "Server web01"}},
+				{Name: "web02", Depth: 1, Via: "HAS_MOUNT", Path: []string{"Storage nas01:/export", "Server web02"}},
+				{Name: "lb01", Depth: 2, Via: "CONNECTED", Path: []string{"Storage nas01:/export", "Server web01", "Server lb01"}},
+			},
+			"Service": {
+				{Name: "nginx", Depth: 2, Via: "RUNNING", Path: []string{"Storage nas01:/export", "Server web01", "Service nginx"}},
+				{Name: "haproxy", Depth: 3, Via: "RUNNING", Path: []string{"Storage nas01:/export", "Server web01", "Server lb01", "Service haproxy"}},
+			},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			impact := NewImpact(graph, graph.Node("Storage/nas01:/export"), traversal, test.depth)
+			if !reflect.DeepEqual(impact.Affected, test.want) {
+				t.Errorf("got\n%v\nwant\n%v", impact.Affected, test.want)
+			}
+		})
+	}
+}
+
+func TestParseImpactTraversal(t *testing.T) {
+	traversal, err := parseImpactTraversal("HAS_MOUNT:in, RUNNING:out,CONNECTED:both")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"HAS_MOUNT": "in", "RUNNING": "out", "CONNECTED": "both"}; !reflect.DeepEqual(traversal, want) {
+		t.Errorf("got %v, want %v", traversal, want)
+	}
+
+	for _, value := range []string{"", "RUNNING", "RUNNING:up", "RUN NING:in"} {
+		if _, err := parseImpactTraversal(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
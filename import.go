@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// runImport loads the configuration items that can't be discovered over SSH, such as
+// racks, SAN arrays or external services, from files:
+//
+//	graphcmdb import [options] <file>...
+//
+// CSV files are mapped by a "relation" or "properties" plugin file given with -mapping,
+// whose $1, $2... refer to the fields of each row. JSON files hold a graph fragment, the
+// output of "graph" plugins, restricted to the allowed labels and relationships of the
+// mapping when one is given. Relationships are stamped with the mapping name as plugin
+// and with the server, or the source of the import, so that re-importing a file
+// reconciles the relationships of the rows it no longer contains.
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	mappingFileName := flags.String("mapping", "", "plugin file mapping the fields of the csv rows, or restricting the json fragments")
+	serverName := flags.String("server", "", "existing server the imported items are attached to")
+	source := flags.String("source", "", "name of the import in the server property of the relationships when there is no -server, file name by default")
+	header := flags.Bool("header", false, "skip the first line of the csv files")
+	dryRun := flags.Bool("dry-run", false, "print the planned graph changes without writing")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb import [options] <file>...")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var mapping *Plugin
+	if *mappingFileName != "" {
+		var err error
+		mapping, err = LoadPlugin(*mappingFileName)
+		if err != nil {
+			log.Fatal("Can't load mapping " + *mappingFileName + ": " + err.Error())
+		}
+	}
+
+	ctx := context.Background()
+	store, err := NewStore(ctx, neoOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	var before *Graph
+	if *dryRun || *serverName != "" {
+		before, err = store.Query(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *dryRun {
+		log.Println("Dry run: changes are applied to an in-memory copy of the graph")
+		store = NewMemoryStore(before.Clone())
+	}
+
+	var server *Node
+	if *serverName != "" {
+		existing := before.Node(nodeKey("Server", *serverName))
+		if existing == nil {
+			log.Fatal("Unknown server " + *serverName)
+		}
+		server = &Node{class: "Server", name: existing.name, properties: map[string]any{}}
+		if ip, found := existing.properties["ip"]; found {
+			server.cond = "ip: '" + fmt.Sprint(ip) + "'"
+			server.properties["ip"] = ip
+		}
+	}
+
+	for _, fileName := range flags.Args() {
+		scope := server
+		if scope == nil {
+			name := *source
+			if name == "" {
+				name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+			}
+			scope = &Node{name: name, properties: map[string]any{}}
+		}
+
+		log.Println("Import " + fileName)
+		batch := NewBatch()
+		batch.SetSource("import")
+		batch.SetServer(scope.name)
+		if mapping != nil {
+			batch.SetSource(mapping.name)
+		}
+		err := importFile(batch, mapping, scope, fileName, *header)
+		if err != nil {
+			log.Fatal("Can't import " + fileName + ": " + err.Error())
+		}
+
+		err = store.Apply(ctx, batch)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *dryRun {
+		after, err := store.Query(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		NewPlan(before, after).WriteText(os.Stdout)
+	}
+}
+
+// importFile queues in batch the nodes and relationships of a CSV or JSON file. scope is
+// the server the items are attached to, or a node without label naming the source of
+// the import.
+func importFile(batch *Batch, mapping *Plugin, scope *Node, fileName string, header bool) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		if mapping == nil || (mapping.kind != "relation" && mapping.kind != "properties") {
+			return errors.New("csv files need a relation or properties mapping")
+		}
+		if scope.class == "" && (mapping.kind == "properties" || mapping.config.GetString("left_node") == "") {
+			return errors.New("mapping " + mapping.name + " sets properties on the server or links it, -server is required")
+		}
+
+		reader := csv.NewReader(strings.NewReader(string(content)))
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return err
+		}
+		if header && len(rows) > 0 {
+			rows = rows[1:]
+		}
+
+		columns := mapping.columns()
+		for index, row := range rows {
+			if len(row) < columns {
+				return errors.New("row " + strconv.Itoa(index+1) + " has " + strconv.Itoa(len(row)) + " fields, mapping " + mapping.name + " uses " + strconv.Itoa(columns))
+			}
+		}
+
+		if mapping.kind == "properties" {
+			return mapping.addProperties(batch, scope, rows)
+		}
+		return mapping.addRelations(batch, scope, rows)
+
+	case ".json":
+		if mapping != nil && mapping.kind != "graph" {
+			return errors.New("json files can only be restricted by a graph mapping")
+		}
+
+		fragment, err := ParseGraphFragment(string(content))
+		if err != nil {
+			return err
+		}
+
+		plugin := "import"
+		var allowedLabels, allowedTypes []string
+		if mapping != nil {
+			plugin = mapping.name
+			allowedLabels = mapping.config.GetStringSlice("allowed_labels")
+			allowedTypes = mapping.config.GetStringSlice("allowed_relationships")
+		}
+		err = fragment.Validate(allowedLabels, allowedTypes)
+		if err != nil {
+			return err
+		}
+		if scope.class == "" {
+			for _, rel := range fragment.Relationships {
+				if rel.From == fragmentServerID || rel.To == fragmentServerID {
+					return errors.New("the fragment references " + fragmentServerID + ", -server is required")
+				}
+			}
+		}
+
+		return fragment.AddTo(batch, scope, plugin)
+	}
+
+	return errors.New("unsupported file type, expected .csv or .json")
+}
+
+var columnRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// columns returns the number of fields the rows mapped by the plugin need: the highest
+// $N it refers to.
+func (p *Plugin) columns() int {
+	columns := 0
+	var walk func(value any)
+	walk = func(value any) {
+		switch v := value.(type) {
+		case string:
+			for _, match := range columnRegexp.FindAllStringSubmatch(v, -1) {
+				if n, _ := strconv.Atoi(match[1]); n > columns {
+					columns = n
+				}
+			}
+		case map[string]any:
+			for _, item := range v {
+				walk(item)
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(p.config.AllSettings())
+
+	return columns
+}
@@ -3,18 +3,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"io"
 	"log"
 	"os"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 	"github.com/pkg/sftp"
 	"github.com/segmentio/ksuid"
-	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -25,9 +25,11 @@ type Server struct {
 }
 
 type Node struct {
+	id         string
 	class      string
 	name       string
 	cond       string
+	keys       map[string]any
 	properties map[string]any
 }
 
@@ -47,194 +49,6 @@ type SSHClient struct {
 	protocol   string
 }
 
-func (n Node) Add(session neo4j.SessionWithContext, ctx context.Context) (any, error) {
-	return session.ExecuteWrite(ctx, n.getAddTransaction(ctx))
-}
-
-func (n Node) getAddTransaction(ctx context.Context) neo4j.ManagedTransactionWork {
-	currentStatement := "CREATE (a:" + n.class + " {name: $name"
-	if n.properties != nil {
-		for field := range n.properties {
-			currentStatement += ", " + field + ": $" + field
-		}
-	} else {
-		n.properties = map[string]any{"name": ""}
-	}
-	currentStatement += "}) return a"
-
-	n.properties["name"] = n.name
-	return func(tx neo4j.ManagedTransaction) (any, error) {
-		var result, err = tx.Run(ctx, currentStatement, n.properties)
-		if err != nil {
-			return nil, err
-		}
-
-		return result.Consume(ctx)
-	}
-}
-
-func (n Node) Update(session neo4j.SessionWithContext, ctx context.Context) (any, error) {
-	return session.ExecuteWrite(ctx, n.getUpdateTransaction(ctx))
-}
-
-func (n Node) getUpdateTransaction(ctx context.Context) neo4j.ManagedTransactionWork {
-	currentStatement := "MATCH (a:" + n.class + " {name: $name}) SET "
-	first := true
-	if n.properties != nil {
-		for field := range n.properties {
-			if !first {
-				currentStatement += ", "
-			}
-			currentStatement += "a." + field + "= $" + field
-			first = false
-		}
-	} else {
-		n.properties = map[string]any{"name": ""}
-	}
-	currentStatement += " return a"
-
-	n.properties["name"] = n.name
-	return func(tx neo4j.ManagedTransaction) (any, error) {
-		var result, err = tx.Run(ctx, currentStatement, n.properties)
-		if err != nil {
-			return nil, err
-		}
-
-		return result.Consume(ctx)
-	}
-}
-
-func (n Node) Exists(session neo4j.SessionWithContext, ctx context.Context) (bool, error) {
-	count, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		fieldMap := map[string]any{}
-		if n.cond == "" {
-			n.cond = "name: $name"
-			fieldMap["name"] = n.name
-		}
-		result, err := tx.Run(ctx, "MATCH (a:"+n.class+" {"+n.cond+"}) RETURN count(a) as count", fieldMap)
-		if err != nil {
-			return nil, err
-		}
-
-		for result.Next(ctx) {
-			count, found := result.Record().Get("count")
-			if found {
-				return count, nil
-			}
-		}
-
-		return 0, nil
-	})
-	if err != nil {
-		return false, err
-	}
-
-	if count.(int64) > 0 {
-		return true, nil
-	}
-
-	return false, nil
-}
-
-func (r Relationship) Add(session neo4j.SessionWithContext, ctx context.Context) (any, error) {
-	return session.ExecuteWrite(ctx, r.getAddTransaction(ctx))
-}
-
-func (r Relationship) getAddTransaction(ctx context.Context) neo4j.ManagedTransactionWork {
-	fieldMap := map[string]any{}
-	if r.left.cond == "" {
-		r.left.cond = "name: $nameL"
-	}
-	if r.right.cond == "" {
-		r.right.cond = "name: $nameR"
-		fieldMap["nameR"] = r.right.name
-	}
-	currentStatement := "MATCH (a:" + r.left.class + " {" + r.left.cond + "}), (b:" + r.right.class + " {" + r.right.cond + "}) CREATE (a)-[r:" + r.class
-	if r.properties != nil {
-		first := true
-		for field := range r.properties {
-			if first {
-				currentStatement += " {"
-				first = false
-			} else {
-				currentStatement += ", "
-			}
-			currentStatement += field + ": $" + field
-			fieldMap[field] = r.properties[field]
-		}
-		if !first {
-			currentStatement += "}"
-		}
-	}
-	currentStatement += "]->(b) return a"
-
-	fieldMap["nameL"] = r.left.name
-	fieldMap["nameR"] = r.right.name
-
-	//log.Println(currentStatement)
-	//log.Println(fieldMap)
-
-	return func(tx neo4j.ManagedTransaction) (any, error) {
-		var result, err = tx.Run(ctx, currentStatement, fieldMap)
-		if err != nil {
-			return nil, err
-		}
-
-		return result.Consume(ctx)
-	}
-}
-
-func (r Relationship) Delete(session neo4j.SessionWithContext, ctx context.Context) (any, error) {
-	return session.ExecuteWrite(ctx, r.getDeleteTransaction(ctx))
-}
-
-func (r Relationship) getDeleteTransaction(ctx context.Context) neo4j.ManagedTransactionWork {
-	return func(tx neo4j.ManagedTransaction) (any, error) {
-		var result, err = tx.Run(ctx, "MATCH (a:"+r.left.class+" {name: $nameL})-[c:"+r.class+"]->(b:"+r.right.class+" {name: $nameR}) DELETE c return a", map[string]any{"nameL": r.left.name, "nameR": r.right.name})
-		if err != nil {
-			return nil, err
-		}
-
-		return result.Consume(ctx)
-	}
-}
-
-func (r Relationship) Exists(session neo4j.SessionWithContext, ctx context.Context) (bool, error) {
-	count, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		fieldMap := map[string]any{}
-		if r.left.cond == "" {
-			r.left.cond = "name: $nameL"
-			fieldMap["nameL"] = r.left.name
-		}
-		if r.right.cond == "" {
-			r.right.cond = "name: $nameR"
-			fieldMap["nameR"] = r.right.name
-		}
-		result, err := tx.Run(ctx, "MATCH (a:"+r.left.class+" {"+r.left.cond+"})-[c:"+r.class+"]->(b:"+r.right.class+"{"+r.right.cond+"}) RETURN count(a) as count", fieldMap)
-		if err != nil {
-			return nil, err
-		}
-
-		for result.Next(ctx) {
-			count, found := result.Record().Get("count")
-			if found {
-				return count, nil
-			}
-		}
-
-		return 0, nil
-	})
-	if err != nil {
-		return false, err
-	}
-
-	if count.(int64) > 0 {
-		return true, nil
-	}
-
-	return false, nil
-}
-
 func (client SSHClient) executeScript(script string) (string, error) {
 	tempFile := ksuid.New()
 	dstFile, err := client.sftp.Create("/tmp/" + tempFile.String())
@@ -295,15 +109,71 @@ func (s *SSHClient) Connect() error {
 	return nil
 }
 
+func (s *SSHClient) Close() {
+	if s.sftp != nil {
+		s.sftp.Close()
+	}
+	if s.connection != nil {
+		s.connection.Close()
+	}
+}
+
+// commands maps the first command line argument to the command it runs. Without a
+// known command graphcmdb runs the discovery with the positional arguments:
+//
+//	graphcmdb <log file> <ssh user> <ssh password> <server list> <neo4j host> <neo4j port> <neo4j user> <neo4j password>
+var commands = map[string]func(args []string){
+	"asof":         runAsOf,
+	"audit":        runAudit,
+	"diff":         runDiff,
+	"export":       runExport,
+	"history":      runHistory,
+	"impact":       runImpact,
+	"import":       runImport,
+	"node":         runNode,
+	"notify":       runNotify,
+	"prune":        runPrune,
+	"relationship": runRelationship,
+	"schema":       runSchema,
+	"serve":        runServe,
+}
+
 func main() {
-	logFileName := os.Args[1]
-	user := os.Args[2]
-	pass := os.Args[3]
-	discoveryListFileName := os.Args[4]
-	neoHost := os.Args[5]
-	neoPort := os.Args[6]
-	neoUser := os.Args[7]
-	neoPass := os.Args[8]
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	discover(os.Args[1:])
+}
+
+// discover runs the plugins on every server of the server list and stores what they
+// report, or with -dry-run only prints the changes it would make.
+func discover(args []string) {
+	flags := flag.NewFlagSet("graphcmdb", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "collect without writing and print the planned graph changes")
+	planFormat := flags.String("plan-format", "text", "format of the dry run plan: text or json")
+	planOutput := flags.String("plan-output", "", "file receiving the dry run plan instead of the standard output")
+	flags.Parse(args)
+
+	if flags.NArg() != 8 || (*planFormat != "text" && *planFormat != "json") {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatal("Usage: graphcmdb [-dry-run] [-plan-format text|json] [-plan-output file] <log file> <ssh user> <ssh password> <server list> <neo4j host> <neo4j port> <neo4j user> <neo4j password>\n       graphcmdb <" + strings.Join(names, "|") + "> [options]")
+	}
+
+	args = flags.Args()
+	logFileName := args[0]
+	user := args[1]
+	pass := args[2]
+	discoveryListFileName := args[3]
+	neoOptions := &Neo4jOptions{host: args[4], port: args[5], user: args[6], pass: args[7]}
+	neoOptions.LoadConfig()
 
 	now := time.Now()
 	logFile, err := os.OpenFile(logFileName+"_"+strconv.Itoa(now.Year())+strconv.Itoa(now.YearDay())+strconv.Itoa(now.Hour())+strconv.Itoa(now.Minute())+strconv.Itoa(now.Second())+".log", os.O_CREATE|os.O_WRONLY, 0666)
@@ -332,403 +202,166 @@ func main() {
 		discoveryList = append(discoveryList, currentServer)
 	}
 
-	dbUri := "neo4j://" + neoHost + ":" + neoPort
-
-	log.Println("Connecting to Neo4j at " + dbUri)
-	driver, err := neo4j.NewDriverWithContext(dbUri, neo4j.BasicAuth(neoUser, neoPass, ""))
+	ctx := context.Background()
+	store, err := NewStore(ctx, neoOptions)
 	if err != nil {
-		log.Fatal("Can't connect to Neo4j database " + dbUri + ": " + err.Error())
+		log.Fatal(err)
 	}
-	ctx := context.Background()
-	defer driver.Close(ctx)
+	defer store.Close(ctx)
 
-	neoSession := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer neoSession.Close(ctx)
+	var before *Graph
+	if *dryRun {
+		before, err = store.Query(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Dry run: changes are applied to an in-memory copy of the graph")
+		store = NewMemoryStore(before.Clone())
+	}
+
+	plugins := LoadPlugins("./plugins")
+	var checkReport []CheckResult
+
+	run := NewDiscoveryRun(plugins)
+	log.Println("Start discovery run " + run.id)
+	err = run.Start(store, ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	for _, currentServer := range discoveryList {
-		server := new(Node)
-		server.class = "Server"
-		server.name = currentServer.vmName
-		server.cond = "ip: '" + currentServer.IP + "'"
-		server.properties = map[string]any{
-			"ip": currentServer.IP,
+		results, err := discoverServer(ctx, store, plugins, run, currentServer, user, pass)
+		if err != nil {
+			log.Fatal(err)
 		}
+		checkReport = append(checkReport, results...)
+	}
+
+	err = run.Finish(store, ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		//log.Println(server)
+	printCheckReport(checkReport)
 
-		log.Println("--- Start discovery of server " + currentServer.vmName + "(" + currentServer.IP + ")")
-		found, err := server.Exists(neoSession, ctx)
+	if *dryRun {
+		after, err := store.Query(ctx)
 		if err != nil {
 			log.Fatal(err)
 		}
+		writePlan(NewPlan(before, after), *planFormat, *planOutput)
+	}
+}
 
-		if !found {
-			log.Println("Add server to Neo4j")
-			_, err := server.Add(neoSession, ctx)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Println("Update server to Neo4j")
-			_, err := server.Update(neoSession, ctx)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
+// discoverServer runs the plugins on a server of run and stores what they report in a
+// single batch. It returns the results of the service checks.
+func discoverServer(ctx context.Context, store GraphStore, plugins []*Plugin, run *DiscoveryRun, currentServer Server, user string, pass string) ([]CheckResult, error) {
+	batch, checkReport, err := collectServer(plugins, run, currentServer, user, pass)
+	if err != nil {
+		return nil, err
+	}
 
-		sshClient := new(SSHClient)
+	return checkReport, store.Apply(ctx, batch)
+}
 
-		sshClient.config = &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{ssh.Password(pass)},
-		}
+// collectServer runs the plugins on a server of run and returns the batch of what they
+// report, without writing it, along with the results of the service checks, and fails
+// when the output of a plugin can't be queued. The batch of a server that can't be
+// reached is empty, so that it isn't stamped as seen and
+// ages like any item discovery no longer reports.
+func collectServer(plugins []*Plugin, run *DiscoveryRun, currentServer Server, user string, pass string) (*Batch, []CheckResult, error) {
+	var checkReport []CheckResult
+	server := new(Node)
+	server.class = "Server"
+	server.name = currentServer.vmName
+	server.cond = "ip: '" + currentServer.IP + "'"
+	server.properties = map[string]any{
+		"ip": currentServer.IP,
+	}
+
+	//log.Println(server)
 
-		sshClient.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
-		sshClient.ip = currentServer.IP
-		sshClient.port = "22"
-		sshClient.protocol = "tcp"
+	log.Println("--- Start discovery of server " + currentServer.vmName + "(" + currentServer.IP + ")")
+	batch := NewBatch()
+	batch.SetSource("discovery")
+	batch.SetServer(server.name)
+	batch.SetRun(run)
 
-		err = sshClient.Connect()
+	sshClient := new(SSHClient)
+
+	sshClient.config = &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.Password(pass)},
+	}
+
+	sshClient.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	sshClient.ip = currentServer.IP
+	sshClient.port = "22"
+	sshClient.protocol = "tcp"
+
+	err := sshClient.Connect()
+	defer sshClient.Close()
+	if err != nil {
+		log.Println("Can't connect to server " + currentServer.vmName + ", left unchanged: " + err.Error())
+		return batch, nil, nil
+	}
+
+	err = batch.UpsertNode(server, true, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = run.Cover(batch, server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, plugin := range plugins {
+		log.Println("Run plugin " + plugin.name)
+		out, err := sshClient.executeScript(plugin.Script())
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		dirList, _ := os.ReadDir("./plugins")
-
-		for _, dir := range dirList {
-			log.Println("Load plugin " + dir.Name())
-			viper.SetConfigType("json")
-			viper.SetConfigFile("./plugins/" + dir.Name())
-			viper.ReadInConfig()
-
-			pluginType := viper.GetString("type")
-			pluginScript := viper.GetString("script")
-
-			out, err := sshClient.executeScript(pluginScript)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-
-			switch pluginType {
-			case "properties":
-				//pluginOutputFormat := viper.GetString("output_format")
-				pluginParams := viper.GetStringMap("node_params")
-				cols_regexp := regexp.MustCompile(`\$(\d+)`)
-
-				lines := strings.Split(string(out), "\n")
-				for index := range lines {
-					if lines[index] == "" {
-						log.Println("Skip " + lines[index])
-						continue
-					}
-					log.Println(lines[index])
-
-					values := strings.Split(lines[index], ",")
-
-					for field := range pluginParams {
-						match := cols_regexp.FindStringSubmatch(pluginParams[field].(string))
-						for k, v := range match {
-							if k == 0 {
-								continue
-							}
-							fieldIndex, _ := strconv.Atoi(v)
-							//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
-
-							server.properties[field] = strings.ReplaceAll(pluginParams[field].(string), "$"+v, values[fieldIndex-1])
-						}
-					}
-
-					//log.Println(server)
-
-					log.Println("Update " + server.class + " to Neo4j")
-					_, err := server.Update(neoSession, ctx)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-			case "relation":
-				//pluginOutputFormat := viper.GetString("output_format")
-				pluginLNode := viper.GetString("left_node")
-				pluginLName := viper.GetString("left_name")
-				pluginLCond := viper.GetString("left_cond")
-				pluginLParams := viper.GetStringMap("left_params")
-				pluginRNode := viper.GetString("right_node")
-				pluginRName := viper.GetString("right_name")
-				pluginRCond := viper.GetString("right_cond")
-				pluginRParams := viper.GetStringMap("right_params")
-				pluginRelName := viper.GetString("rel_name")
-				pluginRelParams := viper.GetStringMap("rel_params")
-				pluginEnableNodeCreation := viper.GetString("enable_node_creation")
-				pluginEnableNodeUpdate := viper.GetString("enable_node_update")
-				pluginEnableRelDelete := viper.GetString("enable_relation_delete")
-				//pluginEnableRelUpdate := viper.GetString("enable_relation_update")
-
-				cols_regexp := regexp.MustCompile(`\$(\d+)`)
-
-				lines := strings.Split(string(out), "\n")
-				for index := range lines {
-					if lines[index] == "" {
-						log.Println("Skip " + lines[index])
-						continue
-					}
-
-					values := strings.Split(lines[index], ",")
-
-					//log.Println(pluginLParams)
-					leftNode := new(Node)
-					if pluginLNode == "" {
-						leftNode.class = server.class
-						leftNode.name = server.name
-						leftNode.cond = server.cond
-						leftNode.properties = make(map[string]any)
-						for k, v := range server.properties {
-							leftNode.properties[k] = v
-						}
-					} else {
-						leftNode.class = pluginLNode
-						leftNode.name = pluginLName
-						leftNode.cond = pluginLCond
-						leftNode.properties = make(map[string]any)
-						for k, v := range pluginLParams {
-							leftNode.properties[k] = v
-						}
-					}
-
-					match := cols_regexp.FindStringSubmatch(leftNode.name)
-					for k, v := range match {
-						if k == 0 {
-							continue
-						}
-						fieldIndex, _ := strconv.Atoi(v)
-						//log.Println("name: " + v + " => " + values[fieldIndex-1])
-
-						leftNode.name = strings.ReplaceAll(leftNode.name, "$"+v, values[fieldIndex-1])
-					}
-
-					match = cols_regexp.FindStringSubmatch(pluginLCond)
-					for k, v := range match {
-						if k == 0 {
-							continue
-						}
-						fieldIndex, _ := strconv.Atoi(v)
-						//log.Println("cond: " + v + " => " + values[fieldIndex-1])
-
-						leftNode.cond = strings.ReplaceAll(leftNode.cond, "$"+v, values[fieldIndex-1])
-					}
-
-					for field := range leftNode.properties {
-						match := cols_regexp.FindStringSubmatch(leftNode.properties[field].(string))
-						for k, v := range match {
-							if k == 0 {
-								continue
-							}
-							fieldIndex, _ := strconv.Atoi(v)
-							//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
-
-							leftNode.properties[field] = strings.ReplaceAll(leftNode.properties[field].(string), "$"+v, values[fieldIndex-1])
-						}
-					}
-
-					//log.Println(leftNode)
-
-					found, err := leftNode.Exists(neoSession, ctx)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					if !found && pluginEnableNodeCreation == "true" {
-						log.Println("Add " + leftNode.class + " to Neo4j")
-						_, err := leftNode.Add(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					} else if found && pluginEnableNodeUpdate == "true" {
-						log.Println("Update " + leftNode.class + " to Neo4j")
-						_, err := leftNode.Update(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-
-					//log.Println(pluginRParams)
-					rightNode := new(Node)
-					rightNode.class = pluginRNode
-					rightNode.name = pluginRName
-					rightNode.cond = pluginRCond
-					rightNode.properties = make(map[string]any)
-					for k, v := range pluginRParams {
-						rightNode.properties[k] = v
-					}
-
-					match = cols_regexp.FindStringSubmatch(rightNode.name)
-					for k, v := range match {
-						if k == 0 {
-							continue
-						}
-						fieldIndex, _ := strconv.Atoi(v)
-						//log.Println("name: " + v + " => " + values[fieldIndex-1])
-
-						rightNode.name = strings.ReplaceAll(rightNode.name, "$"+v, values[fieldIndex-1])
-					}
-
-					match = cols_regexp.FindStringSubmatch(pluginRCond)
-					for k, v := range match {
-						if k == 0 {
-							continue
-						}
-						fieldIndex, _ := strconv.Atoi(v)
-						//log.Println("cond: " + v + " => " + values[fieldIndex-1])
-
-						rightNode.cond = strings.ReplaceAll(rightNode.cond, "$"+v, values[fieldIndex-1])
-					}
-
-					for field := range rightNode.properties {
-						match := cols_regexp.FindStringSubmatch(rightNode.properties[field].(string))
-						for k, v := range match {
-							if k == 0 {
-								continue
-							}
-							fieldIndex, _ := strconv.Atoi(v)
-							//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
-
-							rightNode.properties[field] = strings.ReplaceAll(rightNode.properties[field].(string), "$"+v, values[fieldIndex-1])
-						}
-					}
-
-					//log.Println(rightNode)
-
-					found, err = rightNode.Exists(neoSession, ctx)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					if !found && pluginEnableNodeCreation == "true" {
-						log.Println("Add " + rightNode.class + " to Neo4j")
-						_, err := rightNode.Add(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					} else if found && pluginEnableNodeUpdate == "true" {
-						log.Println("Update " + rightNode.class + " to Neo4j")
-						_, err := rightNode.Update(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-
-					currentRelationship := new(Relationship)
-					currentRelationship.class = pluginRelName
-					currentRelationship.left = leftNode
-					currentRelationship.right = rightNode
-					currentRelationship.properties = make(map[string]any)
-					for k, v := range pluginRelParams {
-						currentRelationship.properties[k] = v
-					}
-
-					for field := range currentRelationship.properties {
-						match := cols_regexp.FindStringSubmatch(currentRelationship.properties[field].(string))
-						for k, v := range match {
-							if k == 0 {
-								continue
-							}
-							fieldIndex, _ := strconv.Atoi(v)
-							//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
-
-							currentRelationship.properties[field] = strings.ReplaceAll(currentRelationship.properties[field].(string), "$"+v, values[fieldIndex-1])
-						}
-					}
-
-					found, err = currentRelationship.Exists(neoSession, ctx)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					if !found {
-						if pluginEnableRelDelete == "true" {
-							log.Println("Delete relation " + currentRelationship.class + " between " + currentRelationship.left.class + " " + currentRelationship.left.name + " and " + currentRelationship.right.class + " " + currentRelationship.right.name)
-							_, err := currentRelationship.Delete(neoSession, ctx)
-							if err != nil {
-								log.Fatal(err)
-							}
-						} else {
-							log.Println("Add relation " + currentRelationship.class + " between " + currentRelationship.left.class + " " + currentRelationship.left.name + " and " + currentRelationship.right.class + " " + currentRelationship.right.name)
-							_, err := currentRelationship.Add(neoSession, ctx)
-							if err != nil {
-								log.Fatal(err)
-							}
-						}
-					}
-
-					leftNode = nil
-					rightNode = nil
-					currentRelationship = nil
-				}
-			default:
-				//TO DO: move script execution out of switch case
-				pluginScript := viper.GetStringMap("script")
-
-				out, err := sshClient.executeScript(pluginScript["script"].(string))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				currentNode := new(Node)
-				currentNode.class = viper.GetString("type")
-				currentNode.name = viper.GetString("name")
-				currentNode.cond = ""
-				currentNode.properties = make(map[string]any)
-				for k, v := range viper.GetStringMap("details") {
-					currentNode.properties[k] = v
-				}
-
-				log.Println("Target node is " + currentNode.class)
-				if pluginType != "Relation" {
-					found, err := currentNode.Exists(neoSession, ctx)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					if !found {
-						log.Println("Add node type " + pluginType)
-						_, err := currentNode.Add(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-
-					currentRelationship := new(Relationship)
-					currentRelationship.class = pluginScript["relation"].(string)
-					currentRelationship.left = server
-					currentRelationship.right = currentNode
-					currentRelationship.properties = map[string]any{}
-
-					found, err = currentRelationship.Exists(neoSession, ctx)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					log.Println("Script result: " + strings.TrimSuffix(out, "\n"))
-					retValue := strings.TrimSuffix(out, "\n")
-					if err == nil && retValue == pluginScript["truevalue"].(string) && !found {
-						log.Println("Add relation between Server " + server.name + " and " + currentNode.class + " " + currentNode.name)
-						_, err := currentRelationship.Add(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					} else if err == nil && retValue == pluginScript["falsevalue"].(string) && found {
-						log.Println("Remove relation between Server " + server.name + " and " + currentNode.class + " " + currentNode.name)
-						_, err := currentRelationship.Delete(neoSession, ctx)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-				}
-			}
+		batch.SetSource(plugin.name)
+		switch plugin.kind {
+		case "properties":
+			err = plugin.runProperties(batch, server, out)
+		case "relation":
+			err = plugin.runRelation(batch, server, out)
+		case "graph":
+			err = plugin.runGraph(batch, server, out)
+		default:
+			var result CheckResult
+			result, err = plugin.runServiceCheck(batch, server, out)
+			checkReport = append(checkReport, result)
 		}
+		if err != nil {
+			return nil, nil, errors.New("plugin " + plugin.name + " on server " + currentServer.vmName + ": " + err.Error())
+		}
+	}
+
+	return batch, checkReport, nil
+}
 
-		server = nil
+func writePlan(plan *Plan, format string, fileName string) {
+	out := os.Stdout
+	if fileName != "" {
+		file, err := os.Create(fileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if format == "json" {
+		err := plan.WriteJSON(out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
+	plan.WriteText(out)
 }
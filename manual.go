@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// runNode creates, shows, edits and deletes configuration items by hand:
+//
+//	graphcmdb node [options] create <label> <name> [field=value...]
+//	graphcmdb node [options] get <label> <name>
+//	graphcmdb node [options] set <label> <name> field=value...
+//	graphcmdb node [options] unset <label> <name> field...
+//	graphcmdb node [options] delete <label> <name>
+//
+// The properties set by hand are owned by manualSource: discovery no longer overwrites
+// them until they are unset. An item is created with the identity keys of its label,
+// which must be among the field=value arguments and not identify another item already,
+// and is then edited under those keys rather than its name.
+func runNode(args []string) {
+	flags := flag.NewFlagSet("node", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	pluginDir := flags.String("plugins", "./plugins", "directory of the plugins declaring the identity keys of the items")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	minArgs, found := map[string]int{"create": 3, "get": 3, "set": 4, "unset": 4, "delete": 3}[action]
+	if !found || flags.NArg() < minArgs || ((action == "get" || action == "delete") && flags.NArg() > 3) {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb node [options] <create|get|set|unset|delete> <label> <name> [field=value...|field...]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	label, name := flags.Arg(1), flags.Arg(2)
+	if !identifierRegexp.MatchString(label) || isBookkeeping(label) {
+		log.Fatal("Invalid label " + label)
+	}
+
+	ctx := context.Background()
+	store, err := NewStore(ctx, neoOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	graph, err := store.Query(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plugins := LoadPlugins(*pluginDir)
+	node := &Node{class: label, name: name, properties: map[string]any{}}
+	if action != "create" {
+		existing, err := findManualNode(graph, label, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if existing == nil {
+			log.Fatal("Unknown " + label + " " + name)
+		}
+		if action == "get" {
+			printNode(graph, existing)
+			return
+		}
+		node.keys = storedIdentity(existing, plugins)
+	}
+
+	batch := NewBatch()
+	batch.SetSource(manualSource)
+	switch action {
+	case "create", "set":
+		node.properties, err = parseAssignments(flags.Args()[3:])
+		if err == nil && action == "create" {
+			node.keys, err = manualIdentity(label, name, node.properties, plugins)
+			if err == nil {
+				err = checkNewIdentity(graph, label, name, node.keys, plugins)
+			}
+		}
+		if err == nil {
+			err = batch.UpsertNode(node, action == "create", true)
+		}
+	case "unset":
+		err = checkManualFields(flags.Args()[3:])
+		if err == nil {
+			err = batch.RemoveProperties(node, flags.Args()[3:])
+		}
+	case "delete":
+		err = batch.DeleteNode(node)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = store.Apply(ctx, batch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(label + " " + name + ": " + action + " done")
+}
+
+// runRelationship creates, updates and deletes relationships by hand:
+//
+//	graphcmdb relationship [options] set <label> <name> <type> <label> <name> [field=value...]
+//	graphcmdb relationship [options] delete <label> <name> <type> <label> <name>
+//
+// Relationships set by hand belong to the manualSource plugin, so discovery neither
+// updates nor deletes them. Their ends are matched under the identity keys of their
+// labels.
+func runRelationship(args []string) {
+	flags := flag.NewFlagSet("relationship", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	pluginDir := flags.String("plugins", "./plugins", "directory of the plugins declaring the identity keys of the items")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	if flags.NArg() < 6 || (action != "set" && action != "delete") || (action == "delete" && flags.NArg() > 6) {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb relationship [options] <set|delete> <label> <name> <type> <label> <name> [field=value...]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	for _, identifier := range []string{flags.Arg(1), flags.Arg(3), flags.Arg(4)} {
+		if !identifierRegexp.MatchString(identifier) || isBookkeeping(identifier) {
+			log.Fatal("Invalid label or relationship type " + identifier)
+		}
+	}
+
+	ctx := context.Background()
+	store, err := NewStore(ctx, neoOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	graph, err := store.Query(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plugins := LoadPlugins(*pluginDir)
+	var ends []*Node
+	for _, end := range [][2]string{{flags.Arg(1), flags.Arg(2)}, {flags.Arg(4), flags.Arg(5)}} {
+		existing, err := findManualNode(graph, end[0], end[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if existing == nil {
+			log.Fatal("Unknown " + end[0] + " " + end[1])
+		}
+		ends = append(ends, &Node{class: end[0], name: end[1], keys: storedIdentity(existing, plugins)})
+	}
+
+	relationship := &Relationship{
+		left:       ends[0],
+		class:      flags.Arg(3),
+		right:      ends[1],
+		properties: map[string]any{},
+	}
+	batch := NewBatch()
+	batch.SetSource(manualSource)
+	if action == "set" {
+		relationship.properties, err = parseAssignments(flags.Args()[6:])
+		if err == nil {
+			relationship.properties["plugin"] = manualSource
+			err = batch.UpsertRelationship(relationship, relationUpdate)
+		}
+	} else {
+		err = batch.DeleteRelationship(relationship)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = store.Apply(ctx, batch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(flags.Arg(1) + " " + flags.Arg(2) + " -" + flags.Arg(3) + "-> " + flags.Arg(4) + " " + flags.Arg(5) + ": " + action + " done")
+}
+
+// identityKeys returns the identity keys of label: the ones of the core constraints and
+// the ones declared by the plugins, which the schema command enforces.
+func identityKeys(label string, plugins []*Plugin) []string {
+	keys := append([]string{}, coreIdentityKeys[label]...)
+	found := map[string]bool{}
+	for _, key := range keys {
+		found[key] = true
+	}
+	for _, plugin := range plugins {
+		for _, key := range plugin.IdentityKeys()[label] {
+			if !found[key] {
+				found[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
+
+// manualIdentity returns the identity of a node of label and name created by hand with
+// properties, nil when its label has no identity keys, and fails when properties lack
+// some of them.
+func manualIdentity(label string, name string, properties map[string]any, plugins []*Plugin) (map[string]any, error) {
+	keys := identityKeys(label, plugins)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	identity := map[string]any{}
+	var missing []string
+	for _, key := range keys {
+		if key == "name" {
+			identity[key] = name
+		} else if value, found := properties[key]; found {
+			identity[key] = value
+		} else {
+			missing = append(missing, key+"=...")
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.New(label + " " + name + " can't be created without its identity keys " + strings.Join(missing, " "))
+	}
+
+	return identity, nil
+}
+
+// checkNewIdentity fails when keys, the identity returned by manualIdentity for a node
+// of label and name, already identifies a node of graph, which creating the node would
+// otherwise update and rename.
+func checkNewIdentity(graph *Graph, label string, name string, keys map[string]any, plugins []*Plugin) error {
+	identity := keys
+	if identity == nil {
+		identity = map[string]any{"name": name}
+	}
+	for _, node := range graph.nodes {
+		if node.class == label && identityValue(label, storedIdentity(node, plugins)) == identityValue(label, identity) {
+			if node.name == name {
+				return errors.New(label + " " + name + " already exists")
+			}
+			return errors.New(label + " " + node.name + " already has " + formatIdentity(identity))
+		}
+	}
+
+	return nil
+}
+
+// storedIdentity returns the identity node is stored under: the values of the identity
+// keys of its label, or its name when it lacks some of them.
+func storedIdentity(node *Node, plugins []*Plugin) map[string]any {
+	identity := map[string]any{}
+	for _, key := range identityKeys(node.class, plugins) {
+		if key == "name" {
+			identity[key] = node.name
+		} else if value, found := node.properties[key]; found {
+			identity[key] = value
+		} else {
+			return map[string]any{"name": node.name}
+		}
+	}
+	if len(identity) == 0 {
+		return map[string]any{"name": node.name}
+	}
+
+	return identity
+}
+
+// findManualNode returns the node of label named name in graph, nil when there is none,
+// and fails when several nodes of label share the name, which only their identity keys
+// tell apart.
+func findManualNode(graph *Graph, label string, name string) (*Node, error) {
+	var found *Node
+	for _, node := range graph.nodes {
+		if node.class != label || node.name != name {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("several " + label + " items are named " + name)
+		}
+		found = node
+	}
+
+	return found, nil
+}
+
+// formatIdentity formats identity as "key=value" pairs sorted by key.
+func formatIdentity(identity map[string]any) string {
+	var pairs []string
+	for _, key := range sortedKeys(identity) {
+		pairs = append(pairs, key+"="+fmt.Sprint(identity[key]))
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// parseAssignments parses field=value arguments into string properties.
+func parseAssignments(assignments []string) (map[string]any, error) {
+	properties := map[string]any{}
+	for _, assignment := range assignments {
+		field, value, found := strings.Cut(assignment, "=")
+		if !found {
+			return nil, errors.New("expected field=value, got " + assignment)
+		}
+		properties[field] = value
+	}
+
+	return properties, checkManualFields(sortedKeys(properties))
+}
+
+// checkManualFields rejects the property names that are not identifiers or that the
+// discovery maintains itself.
+func checkManualFields(fields []string) error {
+	for _, field := range fields {
+		if !identifierRegexp.MatchString(field) || field == "name" || field == "plugin" || field == "server" || historyIgnoredProperties[field] {
+			return errors.New("property " + field + " can't be edited")
+		}
+	}
+
+	return nil
+}
+
+// printNode prints the properties of node with their source and its relationships.
+func printNode(graph *Graph, node *Node) {
+	sources := propertySources(node.properties)
+	fmt.Println(node.class + " " + node.name)
+	for _, field := range sortedKeys(node.properties) {
+		if field == propertySourcesField {
+			continue
+		}
+		line := "    " + field + ": " + formatHistoryValue(node.properties[field])
+		if source, found := sources[field]; found {
+			line += " (" + source + ")"
+		}
+		fmt.Println(line)
+	}
+
+	for _, r := range graph.relationships {
+		owner := ""
+		if plugin, found := r.properties["plugin"]; found {
+			owner = " (" + fmt.Sprint(plugin) + ")"
+		}
+		if r.left == node {
+			fmt.Println("    -[" + r.class + "]-> " + r.right.class + " " + r.right.name + owner)
+		}
+		if r.right == node {
+			fmt.Println("    <-[" + r.class + "]- " + r.left.class + " " + r.left.name + owner)
+		}
+	}
+}
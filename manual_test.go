@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestManualIdentity(t *testing.T) {
+	config := viper.New()
+	config.Set("identity_keys", []any{map[string]any{"label": "Container", "keys": []any{"host", "name"}}})
+	plugins := []*Plugin{{name: "containers", kind: "graph", config: config}}
+
+	tests := []struct {
+		name       string
+		label      string
+		properties map[string]any
+		want       map[string]any
+	}{
+		{"core keys", "Server", map[string]any{"ip": "192.0.2.1", "os": "linux"}, map[string]any{"ip": "192.0.2.1"}},
+		{"name", "Storage", map[string]any{}, map[string]any{"name": "web01"}},
+		{"plugin keys", "Container", map[string]any{"host": "web01"}, map[string]any{"host": "web01", "name": "web01"}},
+		{"no identity keys", "Application", map[string]any{"owner": "ops"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := manualIdentity(test.label, "web01", test.properties, plugins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	for label, properties := range map[string]map[string]any{"Server": {"os": "linux"}, "Container": {"image": "nginx"}} {
+		if _, err := manualIdentity(label, "web01", properties, plugins); err == nil {
+			t.Errorf("%s created without its identity keys", label)
+		}
+	}
+}
+
+func TestManualNodeIdentity(t *testing.T) {
+	config := viper.New()
+	config.Set("identity_keys", []any{map[string]any{"label": "Container", "keys": []any{"host", "name"}}})
+	plugins := []*Plugin{{name: "containers", kind: "graph", config: config}}
+
+	graph := NewGraph()
+	graph.AddNode(&Node{class: "Server", name: "web01", properties: map[string]any{"ip": "192.0.2.1"}})
+	graph.AddNode(&Node{class: "Server", name: "legacy", properties: map[string]any{}})
+	graph.AddNode(&Node{class: "Container", name: "nginx", properties: map[string]any{"host": "web01"}})
+	graph.AddNode(&Node{class: "Container", name: "nginx", id: "Container|web01|nginx", properties: map[string]any{"host": "web02"}})
+
+	identities := map[string]map[string]any{"web01": {"ip": "192.0.2.1"}, "legacy": {"name": "legacy"}}
+	for name, want := range identities {
+		node, err := findManualNode(graph, "Server", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := storedIdentity(node, plugins); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s stored under %v, want %v", name, got, want)
+		}
+	}
+	if _, err := findManualNode(graph, "Container", "nginx"); err == nil {
+		t.Error("found one of the Container items named nginx")
+	}
+
+	tests := []struct {
+		name    string
+		label   string
+		node    string
+		keys    map[string]any
+		wantErr bool
+	}{
+		{"new server", "Server", "web02", map[string]any{"ip": "192.0.2.2"}, false},
+		{"ip of another server", "Server", "web02", map[string]any{"ip": "192.0.2.1"}, true},
+		{"new storage", "Storage", "/data", map[string]any{"name": "/data"}, false},
+		{"container on a new host", "Container", "nginx", map[string]any{"host": "web03", "name": "nginx"}, false},
+		{"existing container", "Container", "nginx", map[string]any{"host": "web02", "name": "nginx"}, true},
+		{"name of an item stored without its keys", "Server", "legacy", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkNewIdentity(graph, test.label, test.node, test.keys, plugins)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/spf13/viper"
+)
+
+// Notification events, the changes the webhooks subscribe to.
+const (
+	// eventServerCreated is sent when a Server node is created.
+	eventServerCreated = "server_created"
+	// eventServiceStopped is sent when a RUNNING relationship is deleted.
+	eventServiceStopped = "service_stopped"
+	// eventStorageThreshold is sent when the used space of a Storage node, used divided
+	// by allocated, reaches the storage threshold, or when a Storage node is created
+	// above it.
+	eventStorageThreshold = "storage_threshold"
+)
+
+var notificationEvents = []string{eventServerCreated, eventServiceStopped, eventStorageThreshold}
+
+// Notification is the JSON payload posted to the webhooks.
+type Notification struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	At        string      `json:"at"`
+	RunID     string      `json:"run_id,omitempty"`
+	Change    ChangeEvent `json:"change"`
+	Usage     float64     `json:"usage,omitempty"`
+	Threshold float64     `json:"threshold,omitempty"`
+}
+
+// Webhook is an URL the notifications of events, or of every event when empty, are
+// posted to. When secret is set, the X-Graphcmdb-Signature header holds the
+// "sha256=" hex HMAC-SHA256 of the body keyed by secret.
+type Webhook struct {
+	url    string
+	secret string
+	events []string
+}
+
+// Notifier posts the notifications of the changes written by the stores to the
+// webhooks, in the background. Failed deliveries are retried with an exponential
+// backoff; Close waits for the pending ones.
+type Notifier struct {
+	webhooks  []Webhook
+	threshold float64
+	attempts  int
+	backoff   time.Duration
+	client    *http.Client
+	pending   sync.WaitGroup
+}
+
+// NewNotifier reads the "notifications" section of the configuration and returns nil
+// when it declares no webhook:
+//
+//	"notifications": {
+//	    "webhooks": [{"url": "https://alerts.example.com/cmdb", "secret": "...", "events": ["server_created"]}],
+//	    "storage_threshold": 90,
+//	    "attempts": 5,
+//	    "backoff": "1s",
+//	    "timeout": "10s"
+//	}
+func NewNotifier(config *viper.Viper) (*Notifier, error) {
+	config.SetDefault("notifications.storage_threshold", 90)
+	config.SetDefault("notifications.attempts", 5)
+	config.SetDefault("notifications.backoff", "1s")
+	config.SetDefault("notifications.timeout", "10s")
+
+	declared, _ := config.Get("notifications.webhooks").([]any)
+	if len(declared) == 0 {
+		return nil, nil
+	}
+
+	notifier := &Notifier{
+		threshold: config.GetFloat64("notifications.storage_threshold"),
+		attempts:  config.GetInt("notifications.attempts"),
+		backoff:   config.GetDuration("notifications.backoff"),
+		client:    &http.Client{Timeout: config.GetDuration("notifications.timeout")},
+	}
+	if notifier.attempts < 1 {
+		return nil, errors.New("notifications.attempts must be at least 1")
+	}
+	for _, item := range declared {
+		declaration, _ := item.(map[string]any)
+		webhook := Webhook{}
+		webhook.url, _ = declaration["url"].(string)
+		webhook.secret, _ = declaration["secret"].(string)
+		if webhook.url == "" {
+			return nil, errors.New("webhook without url")
+		}
+		events, _ := declaration["events"].([]any)
+		for _, event := range events {
+			name := fmt.Sprint(event)
+			if !isAllowed(name, notificationEvents) {
+				return nil, errors.New("unknown event " + name + " of webhook " + webhook.url)
+			}
+			webhook.events = append(webhook.events, name)
+		}
+		notifier.webhooks = append(notifier.webhooks, webhook)
+	}
+
+	return notifier, nil
+}
+
+// Notify posts the notifications of changes to the webhooks subscribed to them.
+func (n *Notifier) Notify(changes []ChangeEvent) {
+	if n == nil {
+		return
+	}
+
+	for _, notification := range n.notifications(changes) {
+		body, err := json.Marshal(notification)
+		if err != nil {
+			log.Println("Can't encode notification: " + err.Error())
+			continue
+		}
+		for _, webhook := range n.webhooks {
+			if len(webhook.events) > 0 && !isAllowed(notification.Event, webhook.events) {
+				continue
+			}
+			n.pending.Add(1)
+			go func(webhook Webhook, notification Notification) {
+				defer n.pending.Done()
+				n.deliver(webhook, notification, body)
+			}(webhook, notification)
+		}
+	}
+}
+
+// Close waits for the pending deliveries.
+func (n *Notifier) Close() {
+	if n != nil {
+		n.pending.Wait()
+	}
+}
+
+// notifications returns the notifications of the events among changes.
+func (n *Notifier) notifications(changes []ChangeEvent) []Notification {
+	var notifications []Notification
+	for _, change := range changes {
+		notification := Notification{ID: ksuid.New().String(), At: change.At, RunID: change.RunID, Change: change}
+		switch {
+		case change.Kind == changeNodeCreated && change.Label == "Server":
+			notification.Event = eventServerCreated
+		case change.Kind == changeRelationshipDeleted && change.Type == "RUNNING":
+			notification.Event = eventServiceStopped
+		case (change.Kind == changeNodeCreated || change.Kind == changeNodeUpdated) && change.Label == "Storage":
+			before, knownBefore := storageUsage(change.Before)
+			after, knownAfter := storageUsage(change.After)
+			if !knownAfter || after < n.threshold || (knownBefore && before >= n.threshold) {
+				continue
+			}
+			notification.Event = eventStorageThreshold
+			notification.Usage = after
+			notification.Threshold = n.threshold
+		default:
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications
+}
+
+// storageUsage returns the percentage of the allocated space of a Storage node that
+// is used.
+func storageUsage(properties map[string]any) (float64, bool) {
+	used, err := strconv.ParseFloat(fmt.Sprint(properties["used"]), 64)
+	if err != nil {
+		return 0, false
+	}
+	allocated, err := strconv.ParseFloat(fmt.Sprint(properties["allocated"]), 64)
+	if err != nil || allocated <= 0 {
+		return 0, false
+	}
+
+	return used * 100 / allocated, true
+}
+
+// deliver posts body to the webhook until it answers with a 2xx status, waiting
+// backoff, then twice as long, between attempts. Client errors other than 429 are not
+// retried.
+func (n *Notifier) deliver(webhook Webhook, notification Notification, body []byte) {
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		status, err := postNotification(n.client, webhook, notification, body)
+		if err == nil && status/100 == 2 {
+			return
+		}
+		message := "status " + strconv.Itoa(status)
+		if err != nil {
+			message = err.Error()
+		}
+		if attempt == n.attempts || (err == nil && status/100 == 4 && status != http.StatusTooManyRequests) {
+			log.Println("Can't notify " + notification.Event + " " + notification.ID + " to " + webhook.url + ": " + message)
+			return
+		}
+		log.Println("Notify " + notification.Event + " " + notification.ID + " to " + webhook.url + " failed (" + message + "), retry in " + wait.String())
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func postNotification(client *http.Client, webhook Webhook, notification Notification, body []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "graphcmdb")
+	request.Header.Set("X-Graphcmdb-Event", notification.Event)
+	request.Header.Set("X-Graphcmdb-Delivery", notification.ID)
+	if webhook.secret != "" {
+		request.Header.Set("X-Graphcmdb-Signature", signNotification(webhook.secret, body))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	return response.StatusCode, nil
+}
+
+func signNotification(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// runNotify checks the webhook configuration:
+//
+//	graphcmdb notify [options] send <event>
+//	graphcmdb notify [options] receive
+//
+// send posts a sample notification of event to the configured webhooks; receive runs
+// a local webhook printing the notifications it receives and checking their signature.
+func runNotify(args []string) {
+	flags := flag.NewFlagSet("notify", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	listen := flags.String("listen", "localhost:9090", "address the receiver listens on")
+	secret := flags.String("secret", "", "secret the receiver checks the signatures with")
+	fail := flags.Int("fail", 0, "number of deliveries the receiver rejects first, to check the retries")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	if (action != "send" || flags.NArg() != 2 || !isAllowed(flags.Arg(1), notificationEvents)) && (action != "receive" || flags.NArg() != 1) {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb notify [options] send <server_created|service_stopped|storage_threshold>")
+		fmt.Fprintln(os.Stderr, "       graphcmdb notify [options] receive")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if action == "receive" {
+		log.Println("Receive notifications on http://" + *listen + "/")
+		server := &http.Server{Addr: *listen, Handler: notificationReceiver(*secret, *fail), ReadHeaderTimeout: 10 * time.Second}
+		log.Fatal(server.ListenAndServe())
+	}
+
+	notifier := neoOptions.notifier
+	if notifier == nil {
+		log.Fatal("No webhook configured in the notifications section of the configuration")
+	}
+	notifier.Notify([]ChangeEvent{sampleChangeEvent(flags.Arg(1), notifier.threshold)})
+	notifier.Close()
+}
+
+// sampleChangeEvent returns a change sending a notification of event.
+func sampleChangeEvent(event string, threshold float64) ChangeEvent {
+	switch event {
+	case eventServerCreated:
+		return nodeChangeEvent(changeNodeCreated, &Node{class: "Server", name: "sample"}, nil, map[string]any{"name": "sample", "ip": "192.0.2.1"})
+	case eventServiceStopped:
+		return relationshipDeletedEvent(map[string]any{"type": "RUNNING", "left_label": "Server", "left_name": "sample", "right_label": "Service", "right_name": "sample"}, map[string]any{"plugin": "sample"})
+	}
+
+	before := map[string]any{"name": "sample./data", "allocated": "100", "used": strconv.FormatFloat(threshold-1, 'f', -1, 64)}
+	return nodeChangeEvent(changeNodeUpdated, &Node{class: "Storage", name: "sample./data"}, before, map[string]any{"used": strconv.FormatFloat(threshold, 'f', -1, 64)})
+}
+
+// notificationReceiver prints the notifications posted to it, rejecting the first fail
+// ones with a 503 status and, when secret is set, the ones with a wrong signature.
+func notificationReceiver(secret string, fail int) http.Handler {
+	var mu sync.Mutex
+	received := 0
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil || r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusBadRequest)
+			return
+		}
+		signature := r.Header.Get("X-Graphcmdb-Signature")
+		if secret != "" && !hmac.Equal([]byte(signature), []byte(signNotification(secret, body))) {
+			log.Println("Reject " + r.Header.Get("X-Graphcmdb-Delivery") + ": invalid signature " + signature)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+		if received <= fail {
+			log.Println("Reject " + r.Header.Get("X-Graphcmdb-Delivery") + " (" + strconv.Itoa(received) + "/" + strconv.Itoa(fail) + " failures)")
+			http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+			return
+		}
+
+		var indented bytes.Buffer
+		if json.Indent(&indented, body, "", "  ") != nil {
+			indented.Reset()
+			indented.Write(body)
+		}
+		log.Println("Received " + r.Header.Get("X-Graphcmdb-Event") + " " + r.Header.Get("X-Graphcmdb-Delivery") + ":\n" + indented.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
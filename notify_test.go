@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local webhook answering with statuses in turn, then 204, and
+// recording the requests it receives.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedNotification
+}
+
+type receivedNotification struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, receivedNotification{at: time.Now(), header: r.Header, body: body})
+		status := http.StatusNoContent
+		if len(receiver.requests) <= len(receiver.statuses) {
+			status = receiver.statuses[len(receiver.requests)-1]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.Close)
+
+	return receiver
+}
+
+func (r *webhookReceiver) received() []receivedNotification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]receivedNotification{}, r.requests...)
+}
+
+func newTestNotifier(attempts int, webhooks ...Webhook) *Notifier {
+	return &Notifier{webhooks: webhooks, threshold: 90, attempts: attempts, backoff: 10 * time.Millisecond, client: &http.Client{Timeout: time.Second}}
+}
+
+func serverCreatedChange() ChangeEvent {
+	return nodeChangeEvent(changeNodeCreated, &Node{class: "Server", name: "web01"}, nil, map[string]any{"name": "web01", "ip": "192.0.2.1"})
+}
+
+func TestNotifySignature(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	notifier := newTestNotifier(1, Webhook{url: receiver.URL, secret: "s3cret"})
+	notifier.Notify([]ChangeEvent{serverCreatedChange()})
+	notifier.Close()
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d notifications, want 1", len(requests))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(requests[0].body)
+	if got, want := requests[0].header.Get("X-Graphcmdb-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := requests[0].header.Get("X-Graphcmdb-Event"); got != eventServerCreated {
+		t.Errorf("event header %q, want %q", got, eventServerCreated)
+	}
+
+	var notification Notification
+	if err := json.Unmarshal(requests[0].body, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.ID != requests[0].header.Get("X-Graphcmdb-Delivery") || notification.Change.Name != "web01" {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+
+	unsigned := newWebhookReceiver(t)
+	notifier = newTestNotifier(1, Webhook{url: unsigned.URL})
+	notifier.Notify([]ChangeEvent{serverCreatedChange()})
+	notifier.Close()
+	if requests := unsigned.received(); len(requests) != 1 || requests[0].header.Get("X-Graphcmdb-Signature") != "" {
+		t.Errorf("webhook without secret received a signature")
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		want     int
+	}{
+		{"delivered", nil, 3, 1},
+		{"server errors", []int{500, 503}, 5, 3},
+		{"too many requests", []int{429}, 5, 2},
+		{"client error", []int{400}, 5, 1},
+		{"not found", []int{404}, 5, 1},
+		{"attempts exhausted", []int{502, 502, 502, 502}, 3, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(t, test.statuses...)
+			notifier := newTestNotifier(test.attempts, Webhook{url: receiver.URL})
+			notifier.Notify([]ChangeEvent{serverCreatedChange()})
+			notifier.Close()
+
+			requests := receiver.received()
+			if len(requests) != test.want {
+				t.Fatalf("received %d attempts, want %d", len(requests), test.want)
+			}
+			for i := 1; i < len(requests); i++ {
+				wait := notifier.backoff << (i - 1)
+				if elapsed := requests[i].at.Sub(requests[i-1].at); elapsed < wait {
+					t.Errorf("attempt %d after %s, want at least %s", i+1, elapsed, wait)
+				}
+				if requests[i].header.Get("X-Graphcmdb-Delivery") != requests[0].header.Get("X-Graphcmdb-Delivery") {
+					t.Errorf("attempt %d has another delivery id", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyEventFilter(t *testing.T) {
+	all := newWebhookReceiver(t)
+	servers := newWebhookReceiver(t)
+	storage := newWebhookReceiver(t)
+	notifier := newTestNotifier(1,
+		Webhook{url: all.URL},
+		Webhook{url: servers.URL, events: []string{eventServerCreated}},
+		Webhook{url: storage.URL, events: []string{eventStorageThreshold}},
+	)
+	stopped := relationshipDeletedEvent(map[string]any{"type": "RUNNING", "left_label": "Server", "left_name": "web01", "right_label": "Service", "right_name": "nginx"}, map[string]any{})
+	notifier.Notify([]ChangeEvent{serverCreatedChange(), stopped})
+	notifier.Close()
+
+	for _, test := range []struct {
+		name     string
+		receiver *webhookReceiver
+		want     []string
+	}{
+		{"all events", all, []string{eventServerCreated, eventServiceStopped}},
+		{"server_created", servers, []string{eventServerCreated}},
+		{"storage_threshold", storage, nil},
+	} {
+		got := map[string]bool{}
+		for _, request := range test.receiver.received() {
+			got[request.header.Get("X-Graphcmdb-Event")] = true
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s webhook received %v, want %v", test.name, got, test.want)
+		}
+		for _, event := range test.want {
+			if !got[event] {
+				t.Errorf("%s webhook did not receive %s", test.name, event)
+			}
+		}
+	}
+}
+
+func TestNotifierNotifications(t *testing.T) {
+	storage := func(kind string, before map[string]any, written map[string]any) ChangeEvent {
+		return nodeChangeEvent(kind, &Node{class: "Storage", name: "web01./data"}, before, written)
+	}
+	usage := func(used string) map[string]any {
+		return map[string]any{"allocated": "200", "used": used}
+	}
+	relationship := func(kind string, class string) ChangeEvent {
+		return relationshipChangeEvent(kind, class, "Server", "web01", "Service", "nginx", map[string]any{}, nil)
+	}
+
+	tests := []struct {
+		name   string
+		change ChangeEvent
+		event  string
+		usage  float64
+	}{
+		{"server created", serverCreatedChange(), eventServerCreated, 0},
+		{"server updated", nodeChangeEvent(changeNodeUpdated, &Node{class: "Server", name: "web01"}, map[string]any{"os": "a"}, map[string]any{"os": "b"}), "", 0},
+		{"service created", nodeChangeEvent(changeNodeCreated, &Node{class: "Service", name: "nginx"}, nil, map[string]any{}), "", 0},
+		{"running deleted", relationship(changeRelationshipDeleted, "RUNNING"), eventServiceStopped, 0},
+		{"running updated", relationship(changeRelationshipUpdated, "RUNNING"), "", 0},
+		{"mount deleted", relationship(changeRelationshipDeleted, "HAS_MOUNT"), "", 0},
+		{"storage crossing the threshold", storage(changeNodeUpdated, usage("100"), map[string]any{"used": "190"}), eventStorageThreshold, 95},
+		{"storage reaching the threshold", storage(changeNodeUpdated, usage("100"), map[string]any{"used": "180"}), eventStorageThreshold, 90},
+		{"storage below the threshold", storage(changeNodeUpdated, usage("100"), map[string]any{"used": "150"}), "", 0},
+		{"storage already above the threshold", storage(changeNodeUpdated, usage("185"), map[string]any{"used": "190"}), "", 0},
+		{"storage dropping below the threshold", storage(changeNodeUpdated, usage("190"), map[string]any{"used": "100"}), "", 0},
+		{"storage without previous usage", storage(changeNodeUpdated, map[string]any{}, usage("190")), eventStorageThreshold, 95},
+		{"storage without usage", storage(changeNodeUpdated, usage("100"), map[string]any{"used": "unknown"}), "", 0},
+		{"storage created above the threshold", storage(changeNodeCreated, nil, usage("190")), eventStorageThreshold, 95},
+		{"storage created below the threshold", storage(changeNodeCreated, nil, usage("20")), "", 0},
+		{"storage deleted", storage(changeNodeDeleted, usage("190"), nil), "", 0},
+	}
+
+	notifier := newTestNotifier(1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			notifications := notifier.notifications([]ChangeEvent{test.change})
+			if test.event == "" {
+				if len(notifications) != 0 {
+					t.Fatalf("got %s, want no notification", notifications[0].Event)
+				}
+				return
+			}
+			if len(notifications) != 1 {
+				t.Fatalf("got %d notifications, want 1", len(notifications))
+			}
+			notification := notifications[0]
+			if notification.Event != test.event || notification.Usage != test.usage {
+				t.Errorf("got %s at %v%%, want %s at %v%%", notification.Event, notification.Usage, test.event, test.usage)
+			}
+			if notification.ID == "" || notification.Change.Kind != test.change.Kind {
+				t.Errorf("unexpected notification %+v", notification)
+			}
+		})
+	}
+}
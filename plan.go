@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Plan lists the changes a dry run would have made to the graph.
+type Plan struct {
+	Nodes         []PlannedNode         `json:"nodes"`
+	Relationships []PlannedRelationship `json:"relationships"`
+}
+
+// PlannedNode is a node to create or delete, with its properties, or to update, with
+// the properties that change.
+type PlannedNode struct {
+	Action     string                    `json:"action"`
+	Label      string                    `json:"label"`
+	Name       string                    `json:"name"`
+	Properties map[string]any            `json:"properties,omitempty"`
+	Changes    map[string]PropertyChange `json:"changes,omitempty"`
+}
+
+// PlannedRelationship is a relationship to add, update or delete.
+type PlannedRelationship struct {
+	Action     string                    `json:"action"`
+	Type       string                    `json:"type"`
+	From       PlannedEndpoint           `json:"from"`
+	To         PlannedEndpoint           `json:"to"`
+	Properties map[string]any            `json:"properties,omitempty"`
+	Changes    map[string]PropertyChange `json:"changes,omitempty"`
+}
+
+type PlannedEndpoint struct {
+	Label string `json:"label"`
+	Name  string `json:"name"`
+}
+
+// NewPlan compares the graph before and after a dry run. Nodes and relationships are
+// matched by id, which the in-memory store keeps; the removed properties are reported
+// with an After of nil and the timestamps of the discovery are not reported as changes.
+func NewPlan(before *Graph, after *Graph) *Plan {
+	plan := &Plan{Nodes: []PlannedNode{}, Relationships: []PlannedRelationship{}}
+
+	for _, n := range after.nodes {
+		previous := before.Node(n.id)
+		if previous == nil {
+			plan.Nodes = append(plan.Nodes, PlannedNode{Action: "create", Label: n.class, Name: n.name, Properties: plannedProperties(n.properties)})
+		} else if changes := diffSnapshots(previous.properties, n.properties); len(changes) > 0 {
+			plan.Nodes = append(plan.Nodes, PlannedNode{Action: "update", Label: n.class, Name: n.name, Changes: changes})
+		}
+	}
+	for _, n := range before.nodes {
+		if after.Node(n.id) == nil {
+			plan.Nodes = append(plan.Nodes, PlannedNode{Action: "delete", Label: n.class, Name: n.name, Properties: plannedProperties(n.properties)})
+		}
+	}
+
+	previous := map[string]*Relationship{}
+	for _, r := range before.relationships {
+		previous[relationshipKey(r)] = r
+	}
+	for _, r := range after.relationships {
+		key := relationshipKey(r)
+		if p, found := previous[key]; !found {
+			plan.Relationships = append(plan.Relationships, plannedRelationship("add", r, plannedProperties(r.properties), nil))
+		} else if changes := diffSnapshots(p.properties, r.properties); len(changes) > 0 {
+			plan.Relationships = append(plan.Relationships, plannedRelationship("update", r, nil, changes))
+		}
+		delete(previous, key)
+	}
+	for _, r := range before.relationships {
+		if _, found := previous[relationshipKey(r)]; found {
+			plan.Relationships = append(plan.Relationships, plannedRelationship("delete", r, plannedProperties(r.properties), nil))
+		}
+	}
+
+	sort.SliceStable(plan.Nodes, func(i, j int) bool {
+		a, b := plan.Nodes[i], plan.Nodes[j]
+		if a.Label != b.Label {
+			return a.Label < b.Label
+		}
+		return a.Name < b.Name
+	})
+	sort.SliceStable(plan.Relationships, func(i, j int) bool {
+		a, b := plan.Relationships[i], plan.Relationships[j]
+		if a.From != b.From {
+			return a.From.Label+a.From.Name < b.From.Label+b.From.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.To.Label+a.To.Name < b.To.Label+b.To.Name
+	})
+
+	return plan
+}
+
+func relationshipKey(r *Relationship) string {
+	return r.left.id + " -" + r.class + "-> " + r.right.id
+}
+
+func plannedRelationship(action string, r *Relationship, properties map[string]any, changes map[string]PropertyChange) PlannedRelationship {
+	return PlannedRelationship{
+		Action:     action,
+		Type:       r.class,
+		From:       PlannedEndpoint{Label: r.left.class, Name: r.left.name},
+		To:         PlannedEndpoint{Label: r.right.class, Name: r.right.name},
+		Properties: properties,
+		Changes:    changes,
+	}
+}
+
+// plannedProperties leaves out the timestamps of the discovery.
+func plannedProperties(properties map[string]any) map[string]any {
+	planned := map[string]any{}
+	for k, v := range properties {
+		if !historyIgnoredProperties[k] {
+			planned[k] = v
+		}
+	}
+
+	return planned
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.Nodes) == 0 && len(p.Relationships) == 0
+}
+
+// WriteText writes the plan as one line per change, "+" for creations, "~" for
+// updates followed by their property changes and "-" for deletions.
+func (p *Plan) WriteText(w io.Writer) {
+	if p.Empty() {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+
+	symbols := map[string]string{"create": "+", "add": "+", "update": "~", "delete": "-"}
+	for _, n := range p.Nodes {
+		fmt.Fprintln(w, symbols[n.Action]+" "+n.Label+" "+n.Name+formatPlannedProperties(n.Properties))
+		writePlannedChanges(w, n.Changes)
+	}
+	for _, r := range p.Relationships {
+		fmt.Fprintln(w, symbols[r.Action]+" ("+r.From.Label+" "+r.From.Name+")-["+r.Type+"]->("+r.To.Label+" "+r.To.Name+")"+formatPlannedProperties(r.Properties))
+		writePlannedChanges(w, r.Changes)
+	}
+	fmt.Fprintf(w, "%d node and %d relationship changes\n", len(p.Nodes), len(p.Relationships))
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(p)
+}
+
+func formatPlannedProperties(properties map[string]any) string {
+	if len(properties) == 0 {
+		return ""
+	}
+
+	formatted := ""
+	for _, field := range sortedKeys(properties) {
+		if formatted != "" {
+			formatted += ", "
+		}
+		formatted += field + ": " + formatHistoryValue(properties[field])
+	}
+
+	return " {" + formatted + "}"
+}
+
+func writePlannedChanges(w io.Writer, changes map[string]PropertyChange) {
+	for _, field := range sortedKeys(changes) {
+		fmt.Fprintln(w, "    "+field+": "+formatHistoryValue(changes[field].Before)+" -> "+formatHistoryValue(changes[field].After))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testGraph builds a graph from nodes, whose ids are their label and name, and from
+// relationships between their ids.
+func testGraph(nodes []*Node, relationships ...[3]string) *Graph {
+	graph := NewGraph()
+	for _, n := range nodes {
+		graph.AddNode(&Node{class: n.class, name: n.name, properties: copyProperties(n.properties)})
+	}
+	for _, r := range relationships {
+		graph.AddRelationship(&Relationship{left: graph.Node(r[0]), class: r[1], right: graph.Node(r[2]), properties: map[string]any{}})
+	}
+
+	return graph
+}
+
+func TestNewPlan(t *testing.T) {
+	before := testGraph([]*Node{
+		{class: "Server", name: "web01", properties: map[string]any{"os": "linux", "kernel": "6.1", "disk_1": "sdb", "last_seen": "2024-01-01T00:00:00Z"}},
+		{class: "Storage", name: "/old", properties: map[string]any{"device": "sdb"}},
+		{class: "Service", name: "nginx", properties: map[string]any{}},
+	}, [3]string{"Server/web01", "HAS_MOUNT", "Storage//old"}, [3]string{"Server/web01", "RUNNING", "Service/nginx"})
+	before.relationships[1].properties["pid"] = "1"
+	before.relationships[1].properties["port"] = "80"
+	after := testGraph([]*Node{
+		{class: "Server", name: "web01", properties: map[string]any{"os": "linux", "kernel": "6.2", "last_seen": "2024-02-01T00:00:00Z"}},
+		{class: "Service", name: "nginx", properties: map[string]any{"last_seen": "2024-02-01T00:00:00Z"}},
+		{class: "Storage", name: "/data", properties: map[string]any{"device": "sda", "first_seen": "2024-02-01T00:00:00Z"}},
+	}, [3]string{"Server/web01", "HAS_MOUNT", "Storage//data"}, [3]string{"Server/web01", "RUNNING", "Service/nginx"})
+	after.relationships[1].properties["pid"] = "2"
+
+	plan := NewPlan(before, after)
+	wantNodes := []PlannedNode{
+		{Action: "update", Label: "Server", Name: "web01", Changes: map[string]PropertyChange{"kernel": {Before: "6.1", After: "6.2"}, "disk_1": {Before: "sdb"}}},
+		{Action: "create", Label: "Storage", Name: "/data", Properties: map[string]any{"device": "sda"}},
+		{Action: "delete", Label: "Storage", Name: "/old", Properties: map[string]any{"device": "sdb"}},
+	}
+	if !reflect.DeepEqual(plan.Nodes, wantNodes) {
+		t.Errorf("nodes\n%#v\nwant\n%#v", plan.Nodes, wantNodes)
+	}
+
+	server := PlannedEndpoint{Label: "Server", Name: "web01"}
+	wantRelationships := []PlannedRelationship{
+		{Action: "add", Type: "HAS_MOUNT", From: server, To: PlannedEndpoint{Label: "Storage", Name: "/data"}, Properties: map[string]any{}},
+		{Action: "delete", Type: "HAS_MOUNT", From: server, To: PlannedEndpoint{Label: "Storage", Name: "/old"}, Properties: map[string]any{}},
+		{Action: "update", Type: "RUNNING", From: server, To: PlannedEndpoint{Label: "Service", Name: "nginx"}, Changes: map[string]PropertyChange{"pid": {Before: "1", After: "2"}, "port": {Before: "80"}}},
+	}
+	if !reflect.DeepEqual(plan.Relationships, wantRelationships) {
+		t.Errorf("relationships\n%#v\nwant\n%#v", plan.Relationships, wantRelationships)
+	}
+}
+
+func TestNewPlanWithoutChanges(t *testing.T) {
+	graph := testGraph([]*Node{{class: "Server", name: "web01", properties: map[string]any{"os": "linux"}}})
+	seen := testGraph([]*Node{{class: "Server", name: "web01", properties: map[string]any{"os": "linux", "last_seen": "now", "last_run_id": "run"}}})
+
+	plan := NewPlan(graph, seen)
+	if !plan.Empty() {
+		t.Errorf("unexpected changes %#v", plan)
+	}
+	var text bytes.Buffer
+	plan.WriteText(&text)
+	if text.String() != "No changes\n" {
+		t.Errorf("got %q", text.String())
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Plugin is a discovery plugin loaded from a JSON file of the plugins directory. Its
+// type is "properties", "relation", "graph" or, for service checks, the label of the
+// checked node (e.g. "Service").
+type Plugin struct {
+	name   string
+	kind   string
+	config *viper.Viper
+}
+
+func LoadPlugin(fileName string) (*Plugin, error) {
+	config := viper.New()
+	config.SetConfigType("json")
+	config.SetConfigFile(fileName)
+	err := config.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := new(Plugin)
+	plugin.name = strings.TrimSuffix(filepath.Base(fileName), ".json")
+	plugin.kind = config.GetString("type")
+	plugin.config = config
+
+	return plugin, nil
+}
+
+func LoadPlugins(dirName string) []*Plugin {
+	var plugins []*Plugin
+
+	dirList, _ := os.ReadDir(dirName)
+	for _, dir := range dirList {
+		log.Println("Load plugin " + dir.Name())
+		plugin, err := LoadPlugin(filepath.Join(dirName, dir.Name()))
+		if err != nil {
+			log.Println("Can't load plugin " + dir.Name() + ": " + err.Error())
+			continue
+		}
+		plugins = append(plugins, plugin)
+	}
+
+	return plugins
+}
+
+// Script returns the path of the script to run on the server. Service checks declare
+// it inside their "script" object, the other plugin types as a plain string.
+func (p *Plugin) Script() string {
+	if p.isServiceCheck() {
+		return p.config.GetString("script.script")
+	}
+
+	return p.config.GetString("script")
+}
+
+// IdentityKeys returns, by label, the properties identifying the nodes the plugin
+// creates: the keys of the left and right conditions of relation plugins (name when
+// there is no condition), the "identity_keys" declared by graph plugins and the name
+// of the nodes checked by service checks.
+func (p *Plugin) IdentityKeys() map[string][]string {
+	identityKeys := map[string][]string{}
+	switch p.kind {
+	case "properties":
+	case "relation":
+		for _, side := range []string{"left", "right"} {
+			label := p.config.GetString(side + "_node")
+			if label == "" {
+				continue
+			}
+			keys := condKeys(p.config.GetString(side + "_cond"))
+			if len(keys) == 0 {
+				keys = []string{"name"}
+			}
+			identityKeys[label] = keys
+		}
+	case "graph":
+		// "identity_keys": [{"label": "Container", "keys": ["name"]}, ...]
+		declared, _ := p.config.Get("identity_keys").([]any)
+		for _, item := range declared {
+			identity, _ := item.(map[string]any)
+			label, _ := identity["label"].(string)
+			keys, _ := identity["keys"].([]any)
+			if !identifierRegexp.MatchString(label) || len(keys) == 0 {
+				log.Println("Skip invalid identity keys declared by plugin " + p.name)
+				continue
+			}
+			for _, key := range keys {
+				if key, ok := key.(string); ok && identifierRegexp.MatchString(key) {
+					identityKeys[label] = append(identityKeys[label], key)
+				}
+			}
+		}
+	default:
+		identityKeys[p.kind] = []string{"name"}
+	}
+
+	return identityKeys
+}
+
+func (p *Plugin) isServiceCheck() bool {
+	switch p.kind {
+	case "properties", "relation", "graph":
+		return false
+	}
+
+	return true
+}
+
+// outputRows splits the CSV output of a plugin script into rows of values, skipping the
+// empty lines.
+func outputRows(out string) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			log.Println("Skip " + line)
+			continue
+		}
+		rows = append(rows, strings.Split(line, ","))
+	}
+
+	return rows
+}
+
+func (p *Plugin) runProperties(batch *Batch, server *Node, out string) error {
+	return p.addProperties(batch, server, outputRows(out))
+}
+
+// addProperties sets the node_params of the plugin, computed from every row of values,
+// on the server. It fails when the batch rejects the server.
+func (p *Plugin) addProperties(batch *Batch, server *Node, lines [][]string) error {
+	//pluginOutputFormat := p.config.GetString("output_format")
+	pluginParams := p.config.GetStringMap("node_params")
+	pluginAggregation := p.config.GetString("aggregation")
+	pluginAggregationFields := p.config.GetStringMapString("aggregation_fields")
+	cols_regexp := regexp.MustCompile(`\$(\d+)`)
+
+	rows := map[string][]string{}
+
+	for _, values := range lines {
+		log.Println(strings.Join(values, ","))
+
+		for field := range pluginParams {
+			value := pluginParams[field].(string)
+			match := cols_regexp.FindStringSubmatch(value)
+			for k, v := range match {
+				if k == 0 {
+					continue
+				}
+				fieldIndex, _ := strconv.Atoi(v)
+				//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
+
+				value = strings.ReplaceAll(value, "$"+v, values[fieldIndex-1])
+			}
+			rows[field] = append(rows[field], value)
+		}
+	}
+
+	if len(rows) == 0 {
+		log.Println("No output rows, " + server.class + " left unchanged")
+		return nil
+	}
+
+	for field, values := range rows {
+		mode := pluginAggregation
+		if fieldMode, found := pluginAggregationFields[field]; found {
+			mode = fieldMode
+		}
+		aggregateProperty(server.properties, field, mode, values)
+		if mode == "indexed" {
+			err := batch.RemoveIndexedProperties(server, field, len(values))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//log.Println(server)
+
+	return batch.UpsertNode(server, false, true)
+}
+
+// aggregateProperty folds the values a properties plugin collected for field over every
+// output row into properties, according to mode:
+//
+//	last (default)  the value of the last row
+//	list            all the values, as a list property
+//	indexed         one property per row: field_0, field_1, ..., the ones above the
+//	                row count being removed by addProperties
+//	sum, max        numeric reduction; rows that are not numbers are skipped
+func aggregateProperty(properties map[string]any, field string, mode string, values []string) {
+	switch mode {
+	case "list":
+		properties[field] = values
+	case "indexed":
+		for index, value := range values {
+			properties[field+"_"+strconv.Itoa(index)] = value
+		}
+	case "sum", "max":
+		var result float64
+		first := true
+		for _, value := range values {
+			number, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+			if err != nil {
+				log.Println("Skip non numeric value " + value + " for " + field)
+				continue
+			}
+			if first || mode == "max" && number > result {
+				result = number
+			} else if mode == "sum" {
+				result += number
+			}
+			first = false
+		}
+		if first {
+			return
+		}
+		if result == float64(int64(result)) {
+			properties[field] = int64(result)
+		} else {
+			properties[field] = result
+		}
+	default:
+		properties[field] = values[len(values)-1]
+	}
+}
+
+func (p *Plugin) runRelation(batch *Batch, server *Node, out string) error {
+	return p.addRelations(batch, server, outputRows(out))
+}
+
+// addRelations queues the left and right nodes and the relationship the plugin maps
+// every row of values to, then reconciles the relationships the rows no longer report.
+// It fails when the batch rejects one of them.
+func (p *Plugin) addRelations(batch *Batch, server *Node, rows [][]string) error {
+	//pluginOutputFormat := p.config.GetString("output_format")
+	pluginLNode := p.config.GetString("left_node")
+	pluginLName := p.config.GetString("left_name")
+	pluginLCond := p.config.GetString("left_cond")
+	pluginLParams := p.config.GetStringMap("left_params")
+	pluginRNode := p.config.GetString("right_node")
+	pluginRName := p.config.GetString("right_name")
+	pluginRCond := p.config.GetString("right_cond")
+	pluginRParams := p.config.GetStringMap("right_params")
+	pluginRelName := p.config.GetString("rel_name")
+	pluginRelParams := p.config.GetStringMap("rel_params")
+	pluginEnableNodeCreation := p.config.GetString("enable_node_creation")
+	pluginEnableNodeUpdate := p.config.GetString("enable_node_update")
+	pluginEnableRelDelete := p.config.GetString("enable_relation_delete")
+	pluginRelDeleteMode := p.config.GetString("relation_delete_mode")
+	//pluginEnableRelUpdate := p.config.GetString("enable_relation_update")
+
+	cols_regexp := regexp.MustCompile(`\$(\d+)`)
+
+	var seenRelationships [][]string
+	var reconcileTemplate *Relationship
+
+	for _, values := range rows {
+		//log.Println(pluginLParams)
+		leftNode := new(Node)
+		if pluginLNode == "" {
+			leftNode.class = server.class
+			leftNode.name = server.name
+			leftNode.cond = server.cond
+			leftNode.properties = make(map[string]any)
+			for k, v := range server.properties {
+				leftNode.properties[k] = v
+			}
+		} else {
+			leftNode.class = pluginLNode
+			leftNode.name = pluginLName
+			leftNode.cond = pluginLCond
+			leftNode.properties = make(map[string]any)
+			for k, v := range pluginLParams {
+				leftNode.properties[k] = v
+			}
+		}
+
+		match := cols_regexp.FindStringSubmatch(leftNode.name)
+		for k, v := range match {
+			if k == 0 {
+				continue
+			}
+			fieldIndex, _ := strconv.Atoi(v)
+			//log.Println("name: " + v + " => " + values[fieldIndex-1])
+
+			leftNode.name = strings.ReplaceAll(leftNode.name, "$"+v, values[fieldIndex-1])
+		}
+
+		match = cols_regexp.FindStringSubmatch(pluginLCond)
+		for k, v := range match {
+			if k == 0 {
+				continue
+			}
+			fieldIndex, _ := strconv.Atoi(v)
+			//log.Println("cond: " + v + " => " + values[fieldIndex-1])
+
+			leftNode.cond = strings.ReplaceAll(leftNode.cond, "$"+v, values[fieldIndex-1])
+		}
+
+		for field := range leftNode.properties {
+			match := cols_regexp.FindStringSubmatch(leftNode.properties[field].(string))
+			for k, v := range match {
+				if k == 0 {
+					continue
+				}
+				fieldIndex, _ := strconv.Atoi(v)
+				//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
+
+				leftNode.properties[field] = strings.ReplaceAll(leftNode.properties[field].(string), "$"+v, values[fieldIndex-1])
+			}
+		}
+
+		//log.Println(leftNode)
+
+		err := batch.UpsertNode(leftNode, pluginEnableNodeCreation == "true", pluginEnableNodeUpdate == "true")
+		if err != nil {
+			return err
+		}
+
+		//log.Println(pluginRParams)
+		rightNode := new(Node)
+		rightNode.class = pluginRNode
+		rightNode.name = pluginRName
+		rightNode.cond = pluginRCond
+		rightNode.properties = make(map[string]any)
+		for k, v := range pluginRParams {
+			rightNode.properties[k] = v
+		}
+
+		match = cols_regexp.FindStringSubmatch(rightNode.name)
+		for k, v := range match {
+			if k == 0 {
+				continue
+			}
+			fieldIndex, _ := strconv.Atoi(v)
+			//log.Println("name: " + v + " => " + values[fieldIndex-1])
+
+			rightNode.name = strings.ReplaceAll(rightNode.name, "$"+v, values[fieldIndex-1])
+		}
+
+		match = cols_regexp.FindStringSubmatch(pluginRCond)
+		for k, v := range match {
+			if k == 0 {
+				continue
+			}
+			fieldIndex, _ := strconv.Atoi(v)
+			//log.Println("cond: " + v + " => " + values[fieldIndex-1])
+
+			rightNode.cond = strings.ReplaceAll(rightNode.cond, "$"+v, values[fieldIndex-1])
+		}
+
+		for field := range rightNode.properties {
+			match := cols_regexp.FindStringSubmatch(rightNode.properties[field].(string))
+			for k, v := range match {
+				if k == 0 {
+					continue
+				}
+				fieldIndex, _ := strconv.Atoi(v)
+				//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
+
+				rightNode.properties[field] = strings.ReplaceAll(rightNode.properties[field].(string), "$"+v, values[fieldIndex-1])
+			}
+		}
+
+		//log.Println(rightNode)
+
+		err = batch.UpsertNode(rightNode, pluginEnableNodeCreation == "true", pluginEnableNodeUpdate == "true")
+		if err != nil {
+			return err
+		}
+
+		currentRelationship := new(Relationship)
+		currentRelationship.class = pluginRelName
+		currentRelationship.left = leftNode
+		currentRelationship.right = rightNode
+		currentRelationship.properties = make(map[string]any)
+		for k, v := range pluginRelParams {
+			currentRelationship.properties[k] = v
+		}
+		currentRelationship.properties["plugin"] = p.name
+		currentRelationship.properties["server"] = server.name
+
+		for field := range currentRelationship.properties {
+			match := cols_regexp.FindStringSubmatch(currentRelationship.properties[field].(string))
+			for k, v := range match {
+				if k == 0 {
+					continue
+				}
+				fieldIndex, _ := strconv.Atoi(v)
+				//log.Println(field + ":" + v + " => " + values[fieldIndex-1])
+
+				currentRelationship.properties[field] = strings.ReplaceAll(currentRelationship.properties[field].(string), "$"+v, values[fieldIndex-1])
+			}
+		}
+
+		mode := relationCreate
+		if pluginEnableRelDelete == "true" {
+			mode = relationClaim
+		}
+		err = batch.UpsertRelationship(currentRelationship, mode)
+		if err != nil {
+			return err
+		}
+
+		seenRelationships = append(seenRelationships, []string{leftNode.name, rightNode.name})
+		reconcileTemplate = currentRelationship
+
+		leftNode = nil
+		rightNode = nil
+		currentRelationship = nil
+	}
+
+	if pluginEnableRelDelete == "true" {
+		if reconcileTemplate == nil {
+			reconcileTemplate = &Relationship{
+				left:  &Node{class: pluginLNode},
+				class: pluginRelName,
+				right: &Node{class: pluginRNode},
+				properties: map[string]any{
+					"plugin": p.name,
+					"server": server.name,
+				},
+			}
+			if pluginLNode == "" {
+				reconcileTemplate.left.class = server.class
+			}
+		}
+
+		batch.Reconcile(reconcileTemplate, seenRelationships, pluginRelDeleteMode)
+	}
+
+	return nil
+}
+
+// runGraph queues the graph fragment printed by the plugin. Invalid output is logged
+// and ignored; it fails when the batch rejects the fragment.
+func (p *Plugin) runGraph(batch *Batch, server *Node, out string) error {
+	fragment, err := ParseGraphFragment(out)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	err = fragment.Validate(p.config.GetStringSlice("allowed_labels"), p.config.GetStringSlice("allowed_relationships"))
+	if err != nil {
+		log.Println("Reject output of plugin " + p.name + ": " + err.Error())
+		return nil
+	}
+
+	return fragment.AddTo(batch, server, p.name)
+}
+
+// runServiceCheck links the server to the checked node through the plugin relationship
+// while the check reports truevalue, removes the relationship when it reports falsevalue
+// and stores the details printed after the status on the relationship, or on the node
+// when "details_target" is "node". It fails when the batch rejects them.
+func (p *Plugin) runServiceCheck(batch *Batch, server *Node, out string) (CheckResult, error) {
+	currentNode := new(Node)
+	currentNode.class = p.kind
+	currentNode.name = p.config.GetString("name")
+	currentNode.cond = ""
+	currentNode.properties = make(map[string]any)
+	for k, v := range p.config.GetStringMap("details") {
+		currentNode.properties[k] = v
+	}
+
+	log.Println("Target node is " + currentNode.class)
+	log.Println("Script result: " + strings.TrimSuffix(out, "\n"))
+	status, details := parseCheckOutput(out)
+
+	var state string
+	switch status {
+	case p.config.GetString("script.truevalue"):
+		state = checkRunning
+	case p.config.GetString("script.falsevalue"):
+		state = checkStopped
+	default:
+		log.Println("Unexpected result '" + status + "' from plugin " + p.name)
+		return CheckResult{server: server.name, plugin: p.name, target: currentNode.name, state: checkUnknown, details: map[string]any{"output": status}}, nil
+	}
+
+	detailsTarget := p.config.GetString("script.details_target")
+	if detailsTarget == "node" && state == checkRunning {
+		for k, v := range details {
+			currentNode.properties[k] = v
+		}
+	}
+
+	err := batch.UpsertNode(currentNode, true, detailsTarget == "node" && len(details) > 0 && state == checkRunning)
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	currentRelationship := new(Relationship)
+	currentRelationship.class = p.config.GetString("script.relation")
+	currentRelationship.left = server
+	currentRelationship.right = currentNode
+	currentRelationship.properties = map[string]any{}
+	if detailsTarget != "node" {
+		currentRelationship.properties = details
+	}
+
+	if state == checkRunning {
+		log.Println("Link Server " + server.name + " and " + currentNode.class + " " + currentNode.name)
+		err = batch.UpsertRelationship(currentRelationship, relationUpdate)
+	} else {
+		log.Println("Unlink Server " + server.name + " and " + currentNode.class + " " + currentNode.name)
+		err = batch.DeleteRelationship(currentRelationship)
+	}
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	return CheckResult{server: server.name, plugin: p.name, target: currentNode.name, state: state, details: details}, nil
+}
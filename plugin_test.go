@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAggregateProperty(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		values []string
+		want   map[string]any
+	}{
+		{"last", "", []string{"a", "b"}, map[string]any{"disk": "b"}},
+		{"unknown mode", "first", []string{"a", "b"}, map[string]any{"disk": "b"}},
+		{"list", "list", []string{"a", "b"}, map[string]any{"disk": []string{"a", "b"}}},
+		{"indexed", "indexed", []string{"a", "b"}, map[string]any{"disk_0": "a", "disk_1": "b"}},
+		{"sum", "sum", []string{"1", "2.5", "3"}, map[string]any{"disk": 6.5}},
+		{"sum of integers", "sum", []string{"40%", " 2 "}, map[string]any{"disk": int64(42)}},
+		{"sum of negative values", "sum", []string{"-1", "-2"}, map[string]any{"disk": int64(-3)}},
+		{"sum skips non numeric values", "sum", []string{"1", "n/a", "2"}, map[string]any{"disk": int64(3)}},
+		{"max", "max", []string{"1", "7", "3"}, map[string]any{"disk": int64(7)}},
+		{"max of negative values", "max", []string{"-5", "-2", "-9"}, map[string]any{"disk": int64(-2)}},
+		{"max skips non numeric values", "max", []string{"n/a", "1.5", "x"}, map[string]any{"disk": 1.5}},
+		{"no numeric value", "max", []string{"n/a"}, map[string]any{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			properties := map[string]any{}
+			aggregateProperty(properties, "disk", test.mode, test.values)
+			if !reflect.DeepEqual(properties, test.want) {
+				t.Errorf("got %v, want %v", properties, test.want)
+			}
+		})
+	}
+}
+
+func TestAddPropertiesRemovesIndexedLeftovers(t *testing.T) {
+	config := viper.New()
+	config.Set("node_params", map[string]any{"disk": "$1"})
+	config.Set("aggregation", "indexed")
+	plugin := &Plugin{name: "disks", config: config}
+
+	store := NewMemoryStore(nil)
+	for _, rows := range [][][]string{{{"sda"}, {"sdb"}, {"sdc"}}, {{"sdd"}}} {
+		applyBatch(t, store, "disks", func(batch *Batch) error {
+			if err := batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1"}), true, true); err != nil {
+				return err
+			}
+			return plugin.addProperties(batch, testServer(map[string]any{"ip": "192.0.2.1"}), rows)
+		})
+	}
+
+	properties := storedNode(store, "Server", "web01").properties
+	for field, want := range map[string]any{"disk_0": "sdd", "disk_1": nil, "disk_2": nil, "ip": "192.0.2.1"} {
+		if got := properties[field]; got != want {
+			t.Errorf("%s = %v, want %v", field, got, want)
+		}
+	}
+	if want := map[string]string{"disk_0": "disks", "ip": "disks"}; !reflect.DeepEqual(propertySources(properties), want) {
+		t.Errorf("sources %v, want %v", propertySources(properties), want)
+	}
+}
+
+func TestAddRelationsRejectsInvalidConditions(t *testing.T) {
+	config := viper.New()
+	config.Set("right_node", "Service")
+	config.Set("right_name", "$1")
+	config.Set("right_cond", "port > $2")
+	config.Set("rel_name", "RUNNING")
+	config.Set("enable_node_creation", "true")
+	plugin := &Plugin{name: "services", config: config}
+
+	batch := NewBatch()
+	batch.SetSource("services")
+	if err := plugin.addRelations(batch, testServer(map[string]any{"ip": "192.0.2.1"}), [][]string{{"nginx", "80"}}); err == nil {
+		t.Error("queued a Service matched by an unsupported condition")
+	}
+}
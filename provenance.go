@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Every node records where its properties come from in its property_sources list, one
+// "field=source" entry per property. The source is manualSource for the properties
+// edited by hand with the node command and the name of the plugin, or "discovery" for
+// the server list, otherwise. Discovery never overwrites a property owned by
+// manualSource, nor updates or deletes a relationship whose plugin is manualSource.
+const (
+	manualSource         = "manual"
+	propertySourcesField = "property_sources"
+)
+
+// propertySources returns the source of every property of a node, read from its
+// property_sources list.
+func propertySources(properties map[string]any) map[string]string {
+	var entries []string
+	switch value := properties[propertySourcesField].(type) {
+	case []any:
+		for _, entry := range value {
+			entries = append(entries, fmt.Sprint(entry))
+		}
+	case []string:
+		entries = value
+	}
+
+	sources := map[string]string{}
+	for _, entry := range entries {
+		if field, source, found := strings.Cut(entry, "="); found {
+			sources[field] = source
+		}
+	}
+
+	return sources
+}
+
+func formatPropertySources(sources map[string]string) []string {
+	entries := make([]string, 0, len(sources))
+	for field, source := range sources {
+		entries = append(entries, field+"="+source)
+	}
+	sort.Strings(entries)
+
+	return entries
+}
+
+// writeProperties returns the properties the queued node sets on a node whose current
+// properties are before, nil when the node is created: the properties owned by
+// manualSource are left out unless they are queued manually, and property_sources is
+// updated with the sources of the others, a property keeping its source while its
+// value does not change unless it is set manually.
+func (q *batchNode) writeProperties(before map[string]any) map[string]any {
+	sources := propertySources(before)
+	properties := map[string]any{}
+	for field, value := range q.node.properties {
+		source := q.sources[field]
+		if field == propertySourcesField || sources[field] == manualSource && source != manualSource {
+			continue
+		}
+		properties[field] = value
+		if previous, found := before[field]; source == manualSource || source != "" && (!found || sources[field] == "" || fmt.Sprint(previous) != fmt.Sprint(value)) {
+			sources[field] = source
+		}
+	}
+	if len(sources) > 0 {
+		properties[propertySourcesField] = formatPropertySources(sources)
+	}
+
+	return properties
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// PruneEntity is a node or relationship listed by the prune command.
+type PruneEntity struct {
+	kind     string
+	label    string
+	name     string
+	lastSeen string
+
+	// The ends of a relationship, whose label is its type.
+	leftLabel  string
+	leftName   string
+	rightLabel string
+	rightName  string
+	// before holds the properties of a marked entity before the prune.
+	before map[string]any
+}
+
+func (e PruneEntity) String() string {
+	return e.kind + " " + e.label + " " + e.name + " (last seen " + e.lastSeen + ")"
+}
+
+// change returns the update of the entity on which the prune set written.
+func (e PruneEntity) change(written map[string]any) ChangeEvent {
+	if e.kind == "node" {
+		return nodeChangeEvent(changeNodeUpdated, &Node{class: e.label, name: e.name}, e.before, written)
+	}
+
+	return relationshipChangeEvent(changeRelationshipUpdated, e.label, e.leftLabel, e.leftName, e.rightLabel, e.rightName, e.before, written)
+}
+
+// recordPruneChanges notifies the webhooks of the changes of a committed prune step
+// and writes them to the audit log. The changes being committed, an audit failure is
+// only logged.
+func recordPruneChanges(options *Neo4jOptions, changes []ChangeEvent) {
+	for i := range changes {
+		changes[i].Source = pruneSource
+	}
+	options.notifier.Notify(changes)
+	if err := options.audit.Record(changes); err != nil {
+		log.Println(err)
+	}
+}
+
+const (
+	pruneNodeFilter = "NOT any(l IN labels(n) WHERE l IN $excludedLabels)"
+	pruneRelFilter  = "NOT type(c) IN $excludedTypes"
+	pruneNodeReturn = " RETURN 'node' as kind, labels(n)[0] as label, n.name as name, n.last_seen as last_seen"
+	pruneRelColumns = " type(c) as label, a.name + ' -> ' + b.name as name, c.last_seen as last_seen," +
+		" labels(a)[0] as left_label, a.name as left_name, labels(b)[0] as right_label, b.name as right_name"
+	pruneRelReturn = " RETURN 'relation' as kind," + pruneRelColumns
+	// pruneDetachedReturn lists the relationships that are not expired themselves but
+	// are deleted along with an expired node.
+	pruneDetachedReturn = " RETURN 'detached relation' as kind," + pruneRelColumns
+	// pruneNodeBefore and pruneRelBefore keep the properties of the entities about to
+	// be marked, returned as before to record the changes.
+	pruneNodeBefore = " WITH n, properties(n) as before"
+	pruneRelBefore  = " WITH a, b, c, properties(c) as before"
+)
+
+// pruneSource is the source of the changes made by the prune command.
+const pruneSource = "prune"
+
+// runPrune marks the nodes and relationships not seen by a discovery for more than
+// -days days as stale and, with -delete, removes the ones that have been stale for
+// more than -grace days. Entities without last_seen are never aged.
+func runPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	days := flags.Int("days", 0, "mark entities not seen for this many days as stale")
+	grace := flags.Int("grace", 7, "delete entities stale for more than this many days (with -delete)")
+	remove := flags.Bool("delete", false, "delete stale entities once the grace period is over")
+	dryRun := flags.Bool("dry-run", false, "only list the entities that would be marked or deleted")
+	maxDelete := flags.Int("max", 100, "refuse to delete more than this many entities in one prune, counting the relationships of the deleted nodes")
+	flags.Parse(args)
+
+	if *days <= 0 {
+		fmt.Fprintln(os.Stderr, "prune: -days must be greater than 0")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	params := map[string]any{
+		"now":            formatTimestamp(now),
+		"cutoff":         formatTimestamp(now.AddDate(0, 0, -*days)),
+		"graceCutoff":    formatTimestamp(now.AddDate(0, 0, -*grace)),
+		"excludedLabels": bookkeepingLabels,
+		"excludedTypes":  bookkeepingTypes,
+	}
+
+	driver, err := neoOptions.NewDriver()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer driver.Close(ctx)
+
+	accessMode := neo4j.AccessModeWrite
+	if *dryRun {
+		accessMode = neo4j.AccessModeRead
+	}
+	session := driver.NewSession(ctx, neoOptions.SessionConfig(accessMode))
+	defer session.Close(ctx)
+	defer neoOptions.notifier.Close()
+
+	staleStatements := []string{
+		"MATCH (n) WHERE n.last_seen < $cutoff AND NOT coalesce(n.stale, false) AND " + pruneNodeFilter,
+		"MATCH (a)-[c]->(b) WHERE c.last_seen < $cutoff AND NOT coalesce(c.stale, false) AND " + pruneRelFilter,
+	}
+	expiredStatements := []string{
+		"MATCH (n) WHERE n.stale AND n.stale_since < $graceCutoff AND " + pruneNodeFilter,
+		"MATCH (a)-[c]->(b) WHERE c.stale AND c.stale_since < $graceCutoff AND " + pruneRelFilter,
+		"MATCH (a)-[c]->(b) WHERE NOT coalesce(c.stale AND c.stale_since < $graceCutoff, false) AND " + pruneRelFilter +
+			" AND any(n IN [a, b] WHERE n.stale AND n.stale_since < $graceCutoff AND " + pruneNodeFilter + ")",
+	}
+	expiredQueries := []string{expiredStatements[1] + pruneRelReturn, expiredStatements[2] + pruneDetachedReturn, expiredStatements[0] + pruneNodeReturn}
+
+	if *dryRun {
+		stale, err := pruneQuery(session, ctx, false, params, staleStatements[1]+pruneRelReturn, staleStatements[0]+pruneNodeReturn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entity := range stale {
+			log.Println("Would mark stale: " + entity.String())
+		}
+
+		if *remove {
+			expired, err := pruneQuery(session, ctx, false, params, expiredQueries...)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, entity := range expired {
+				log.Println("Would delete: " + entity.String())
+			}
+			if len(expired) > *maxDelete {
+				log.Println("Prune would be refused: " + strconv.Itoa(len(expired)) + " entities to delete, more than -max " + strconv.Itoa(*maxDelete))
+			}
+		}
+		return
+	}
+
+	revived, err := pruneQuery(session, ctx, true, params,
+		"MATCH (a)-[c]->(b) WHERE c.stale AND c.last_seen >= $cutoff"+pruneRelBefore+" REMOVE c.stale, c.stale_since"+pruneRelReturn+", before",
+		"MATCH (n) WHERE n.stale AND n.last_seen >= $cutoff"+pruneNodeBefore+" REMOVE n.stale, n.stale_since"+pruneNodeReturn+", before")
+	if err != nil {
+		log.Fatal(err)
+	}
+	changes := []ChangeEvent{}
+	for _, entity := range revived {
+		log.Println("Seen again: " + entity.String())
+		changes = append(changes, entity.change(map[string]any{"stale": nil, "stale_since": nil}))
+	}
+	recordPruneChanges(neoOptions, changes)
+
+	stale, err := pruneQuery(session, ctx, true, params,
+		staleStatements[1]+pruneRelBefore+" SET c.stale = true, c.stale_since = $now"+pruneRelReturn+", before",
+		staleStatements[0]+pruneNodeBefore+" SET n.stale = true, n.stale_since = $now"+pruneNodeReturn+", before")
+	if err != nil {
+		log.Fatal(err)
+	}
+	changes = []ChangeEvent{}
+	for _, entity := range stale {
+		log.Println("Mark stale: " + entity.String())
+		changes = append(changes, entity.change(map[string]any{"stale": true, "stale_since": params["now"]}))
+	}
+	recordPruneChanges(neoOptions, changes)
+
+	if !*remove {
+		return
+	}
+
+	expired, err := pruneQuery(session, ctx, false, params, expiredQueries...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(expired) > *maxDelete {
+		log.Fatal("Refuse to prune " + strconv.Itoa(len(expired)) + " entities, more than -max " + strconv.Itoa(*maxDelete))
+	}
+
+	deleted, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		changes, err := recordRelationshipTombstones(ctx, neo4jTx(tx), expiredStatements[1], params, "")
+		if err != nil {
+			return nil, err
+		}
+		result, err := tx.Run(ctx, expiredStatements[1]+" DELETE c", params)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := result.Consume(ctx); err != nil {
+			return nil, err
+		}
+
+		nodeChanges, err := recordNodeTombstones(ctx, neo4jTx(tx), expiredStatements[0], params, "")
+		if err != nil {
+			return nil, err
+		}
+		result, err = tx.Run(ctx, expiredStatements[0]+" DETACH DELETE n", params)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := result.Consume(ctx); err != nil {
+			return nil, err
+		}
+
+		return append(changes, nodeChanges...), nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entity := range expired {
+		log.Println("Delete: " + entity.String())
+	}
+	recordPruneChanges(neoOptions, deleted.([]ChangeEvent))
+	log.Println("Pruned " + strconv.Itoa(len(expired)) + " entities")
+}
+
+// pruneQuery runs the statements in order in one transaction, a write transaction when
+// write is set, and returns the entities they listed.
+func pruneQuery(session neo4j.SessionWithContext, ctx context.Context, write bool, params map[string]any, statements ...string) ([]PruneEntity, error) {
+	execute := session.ExecuteRead
+	if write {
+		execute = session.ExecuteWrite
+	}
+	entities, err := execute(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		var entities []PruneEntity
+		for _, statement := range statements {
+			result, err := tx.Run(ctx, statement, params)
+			if err != nil {
+				return nil, err
+			}
+
+			for result.Next(ctx) {
+				record := result.Record()
+				entity := PruneEntity{}
+				entity.kind = recordString(record, "kind")
+				entity.label = recordString(record, "label")
+				entity.name = recordString(record, "name")
+				entity.lastSeen = recordString(record, "last_seen")
+				entity.leftLabel = recordString(record, "left_label")
+				entity.leftName = recordString(record, "left_name")
+				entity.rightLabel = recordString(record, "right_label")
+				entity.rightName = recordString(record, "right_name")
+				if before, found := record.Get("before"); found {
+					entity.before, _ = before.(map[string]any)
+				}
+				entities = append(entities, entity)
+			}
+			if err := result.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		return entities, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entities.([]PruneEntity), nil
+}
+
+func recordString(record *neo4j.Record, key string) string {
+	value, found := record.Get(key)
+	if !found || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(value)
+}
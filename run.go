@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// timestampLayout is the format of every first_seen, last_seen, started_at and ended_at
+// property. Timestamps are stored as UTC strings so they compare in time order.
+const timestampLayout = "2006-01-02T15:04:05Z"
+
+// DiscoveryRun is one execution of the discovery over the server list. It is stored as a
+// DiscoveryRun node linked to every server it covered.
+type DiscoveryRun struct {
+	id        string
+	startedAt time.Time
+	collector string
+	plugins   []string
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+// parseTimestamp accepts an RFC 3339 timestamp, a local "2006-01-02T15:04:05" one or a
+// plain date, which stands for the end of that day, and returns it in timestampLayout.
+func parseTimestamp(value string) (string, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return formatTimestamp(t), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", value, time.Local); err == nil {
+		return formatTimestamp(t), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return "", errors.New("invalid timestamp " + value + ", expected 2006-01-02, 2006-01-02T15:04:05 or RFC 3339")
+	}
+
+	return formatTimestamp(t.Add(24*time.Hour - time.Second)), nil
+}
+
+// seenProperties returns the last_seen and last_run_id properties to stamp on the
+// nodes and relationships observed now by run, which may be nil.
+func seenProperties(run *DiscoveryRun) map[string]any {
+	properties := map[string]any{"last_seen": formatTimestamp(time.Now())}
+	if run != nil {
+		properties["last_run_id"] = run.id
+	}
+
+	return properties
+}
+
+func NewDiscoveryRun(plugins []*Plugin) *DiscoveryRun {
+	run := new(DiscoveryRun)
+	run.id = ksuid.New().String()
+	run.startedAt = time.Now()
+	run.collector, _ = os.Hostname()
+	for _, plugin := range plugins {
+		run.plugins = append(run.plugins, plugin.name)
+	}
+
+	return run
+}
+
+func (run *DiscoveryRun) node() *Node {
+	return &Node{class: "DiscoveryRun", name: run.id, properties: map[string]any{}}
+}
+
+func (run *DiscoveryRun) Start(store GraphStore, ctx context.Context) error {
+	node := run.node()
+	node.properties["started_at"] = formatTimestamp(run.startedAt)
+	node.properties["collector"] = run.collector
+	node.properties["plugins"] = run.plugins
+
+	batch := NewBatch()
+	batch.SetRun(run)
+	err := batch.UpsertNode(node, true, true)
+	if err != nil {
+		return err
+	}
+
+	return store.Apply(ctx, batch)
+}
+
+// Cover queues the relationship linking the run to a server it discovers.
+func (run *DiscoveryRun) Cover(batch *Batch, server *Node) error {
+	covered := new(Relationship)
+	covered.class = "COVERED"
+	covered.left = run.node()
+	covered.right = server
+	covered.properties = map[string]any{}
+
+	return batch.UpsertRelationship(covered, relationCreate)
+}
+
+func (run *DiscoveryRun) Finish(store GraphStore, ctx context.Context) error {
+	node := run.node()
+	node.properties["ended_at"] = formatTimestamp(time.Now())
+
+	batch := NewBatch()
+	batch.SetRun(run)
+	err := batch.UpsertNode(node, false, true)
+	if err != nil {
+		return err
+	}
+
+	return store.Apply(ctx, batch)
+}
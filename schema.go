@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// SchemaMigration is a versioned set of schema statements. Applied migrations are
+// recorded as SchemaMigration nodes and never run twice.
+type SchemaMigration struct {
+	version    int64
+	name       string
+	statements []string
+}
+
+// schemaMigrations must only be appended to: a released migration is never changed.
+var schemaMigrations = []SchemaMigration{
+	{1, "core uniqueness constraints", []string{
+		uniqueConstraint("Server", "ip"),
+		uniqueConstraint("Storage", "name"),
+		uniqueConstraint("Service", "name"),
+	}},
+	{2, "lookup indexes", []string{
+		"CREATE INDEX server_name IF NOT EXISTS FOR (n:Server) ON (n.name)",
+		uniqueConstraint("DiscoveryRun", "name"),
+		"CREATE INDEX change_changed_at IF NOT EXISTS FOR (n:Change) ON (n.changed_at)",
+		"CREATE INDEX tombstone_kind IF NOT EXISTS FOR (n:Tombstone) ON (n.kind, n.deleted_at)",
+	}},
+}
+
+// coreIdentityKeys are the identity keys of the labels constrained by the core
+// migrations, which the plugins don't declare.
+var coreIdentityKeys = map[string][]string{
+	"Server":  {"ip"},
+	"Storage": {"name"},
+	"Service": {"name"},
+}
+
+func uniqueConstraint(label string, key string) string {
+	return "CREATE CONSTRAINT " + strings.ToLower(label+"_"+key) + "_unique IF NOT EXISTS FOR (n:" + label + ") REQUIRE n." + key + " IS UNIQUE"
+}
+
+// identityMigration returns the migration enforcing the identity keys a plugin declared
+// for a label with a uniqueness constraint. Composite keys need the composite
+// uniqueness constraints of Neo4j 5; the index earlier versions of the migration
+// created for them is dropped first, as Neo4j refuses a constraint over the properties
+// of an existing index.
+func identityMigration(label string, keys []string) SchemaMigration {
+	name := "identity " + label + "(" + strings.Join(keys, ", ") + ")"
+	if len(keys) == 1 {
+		return SchemaMigration{0, name, []string{uniqueConstraint(label, keys[0])}}
+	}
+
+	properties := make([]string, len(keys))
+	for i, key := range keys {
+		properties[i] = "n." + key
+	}
+	index := strings.ToLower(label + "_" + strings.Join(keys, "_"))
+
+	return SchemaMigration{0, name + " unique", []string{
+		"DROP INDEX " + index + " IF EXISTS",
+		"CREATE CONSTRAINT " + index + "_unique IF NOT EXISTS FOR (n:" + label + ") REQUIRE (" + strings.Join(properties, ", ") + ") IS UNIQUE",
+	}}
+}
+
+// runSchema manages the Neo4j constraints and indexes:
+//
+//	graphcmdb schema [options] apply    apply the pending migrations and the plugin identity keys
+//	graphcmdb schema [options] status   list the applied and pending migrations
+func runSchema(args []string) {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	pluginDir := flags.String("plugins", "./plugins", "directory of the plugins whose identity keys are enforced")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (flags.Arg(0) != "apply" && flags.Arg(0) != "status") {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb schema [options] <apply|status>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	driver, err := neoOptions.NewDriver()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer driver.Close(ctx)
+
+	session := driver.NewSession(ctx, neoOptions.SessionConfig(neo4j.AccessModeWrite))
+	defer session.Close(ctx)
+
+	applied, err := appliedMigrations(session, ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pluginMigrations := []SchemaMigration{}
+	identities := map[string]bool{}
+	for _, plugin := range LoadPlugins(*pluginDir) {
+		identityKeys := plugin.IdentityKeys()
+		for _, label := range sortedKeys(identityKeys) {
+			migration := identityMigration(label, identityKeys[label])
+			if !identities[migration.name] {
+				identities[migration.name] = true
+				pluginMigrations = append(pluginMigrations, migration)
+			}
+		}
+	}
+
+	if flags.Arg(0) == "status" {
+		for _, migration := range append(schemaMigrations, pluginMigrations...) {
+			state := "pending"
+			if appliedAt, found := applied[migration.name]; found {
+				state = "applied " + appliedAt
+			}
+			fmt.Println(strconv.FormatInt(migration.version, 10) + " " + migration.name + ": " + state)
+		}
+		return
+	}
+
+	for _, migration := range append(schemaMigrations, pluginMigrations...) {
+		if _, found := applied[migration.name]; found {
+			continue
+		}
+
+		log.Println("Apply schema migration " + strconv.FormatInt(migration.version, 10) + " " + migration.name)
+		for _, statement := range migration.statements {
+			_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+				result, err := tx.Run(ctx, statement, nil)
+				if err != nil {
+					return nil, err
+				}
+
+				return result.Consume(ctx)
+			})
+			if err != nil {
+				log.Fatal("Schema migration " + migration.name + " failed on '" + statement + "': " + err.Error())
+			}
+		}
+
+		_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, "MERGE (m:SchemaMigration {name: $name}) SET m.version = $version, m.applied_at = $applied_at, m.statements = $statements return m",
+				map[string]any{"name": migration.name, "version": migration.version, "applied_at": formatTimestamp(time.Now()), "statements": migration.statements})
+			if err != nil {
+				return nil, err
+			}
+
+			return result.Consume(ctx)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// appliedMigrations returns the applied_at timestamp of the applied migrations by name.
+func appliedMigrations(session neo4j.SessionWithContext, ctx context.Context) (map[string]string, error) {
+	records, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		return collect(ctx, tx, "MATCH (m:SchemaMigration) RETURN m.name as name, m.applied_at as applied_at", nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[string]string{}
+	for _, record := range records.([]*neo4j.Record) {
+		applied[recordString(record, "name")] = recordString(record, "applied_at")
+	}
+
+	return applied, nil
+}
+
+// condKeys returns the property names a plugin condition such as "ip: '$1'" matches on.
+func condKeys(cond string) []string {
+	var keys []string
+	for _, part := range strings.Split(cond, ",") {
+		key, _, found := strings.Cut(part, ":")
+		key = strings.TrimSpace(key)
+		if found && identifierRegexp.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
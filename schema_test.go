@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIdentityMigration(t *testing.T) {
+	tests := []struct {
+		name       string
+		keys       []string
+		want       string
+		statements []string
+	}{
+		{"single key", []string{"ip"}, "identity Server(ip)", []string{
+			"CREATE CONSTRAINT server_ip_unique IF NOT EXISTS FOR (n:Server) REQUIRE n.ip IS UNIQUE",
+		}},
+		{"composite keys", []string{"host", "name"}, "identity Server(host, name) unique", []string{
+			"DROP INDEX server_host_name IF EXISTS",
+			"CREATE CONSTRAINT server_host_name_unique IF NOT EXISTS FOR (n:Server) REQUIRE (n.host, n.name) IS UNIQUE",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migration := identityMigration("Server", test.keys)
+			if migration.name != test.want {
+				t.Errorf("name %q, want %q", migration.name, test.want)
+			}
+			if !reflect.DeepEqual(migration.statements, test.statements) {
+				t.Errorf("statements %q, want %q", migration.statements, test.statements)
+			}
+		})
+	}
+}
@@ -1,13 +1,21 @@
 #!/bin/bash
 
-RESULT=`ps -ef | grep  mysqld | grep -v grep | wc -l`
-if [ $RESULT -eq "0" ]; then
-    RESULT=`ps -ef | grep  mariadbd | grep -v grep | wc -l`
-    if [ $RESULT -eq "0" ]; then
-        echo "0"
-    else
-        echo "1"
-    fi
+PID=`pgrep -o -x mysqld || pgrep -o -x mariadbd`
+if [ -z "$PID" ]; then
+    echo "0"
 else
     echo "1"
+    echo "pid=$PID"
+    VERSION=`mysqld --version 2>/dev/null || mariadbd --version 2>/dev/null`
+    echo "version=`echo $VERSION | grep -o -E '[0-9]+\.[0-9]+\.[0-9]+(-MariaDB)?' | head -1`"
+    PORT=`netstat -ntlp 2>/dev/null | grep "$PID/" | awk '{print $4}' | sed 's/.*://' | head -1`
+    if [ -n "$PORT" ]; then
+        echo "port=$PORT"
+    fi
+    for CONFIG in /etc/my.cnf /etc/mysql/my.cnf; do
+        if [ -f $CONFIG ]; then
+            echo "config=$CONFIG"
+            break
+        fi
+    done
 fi
\ No newline at end of file
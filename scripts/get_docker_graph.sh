@@ -0,0 +1,29 @@
+#!/bin/bash
+
+SEP=""
+echo '{"nodes": ['
+for IMAGE in `docker ps -a --format '{{.Image}}' | sort -u`; do
+    echo "$SEP{\"id\": \"image:$IMAGE\", \"label\": \"Image\", \"keys\": {\"name\": \"$IMAGE\"}}"
+    SEP=","
+done
+for VOLUME in `docker volume ls -q`; do
+    echo "$SEP{\"id\": \"volume:$VOLUME\", \"label\": \"Volume\", \"keys\": {\"name\": \"$HOSTNAME.$VOLUME\"}}"
+    SEP=","
+done
+for CONTAINER in `docker ps -a --format '{{.Names}}'`; do
+    STATE=`docker inspect -f '{{.State.Status}}' $CONTAINER`
+    echo "$SEP{\"id\": \"container:$CONTAINER\", \"label\": \"Container\", \"keys\": {\"name\": \"$HOSTNAME.$CONTAINER\"}, \"properties\": {\"state\": \"$STATE\"}}"
+    SEP=","
+done
+echo '], "relationships": ['
+SEP=""
+for CONTAINER in `docker ps -a --format '{{.Names}}'`; do
+    IMAGE=`docker inspect -f '{{.Config.Image}}' $CONTAINER`
+    echo "$SEP{\"from\": \"\$server\", \"to\": \"container:$CONTAINER\", \"type\": \"RUNS_CONTAINER\"}"
+    echo ",{\"from\": \"container:$CONTAINER\", \"to\": \"image:$IMAGE\", \"type\": \"USES_IMAGE\"}"
+    SEP=","
+    for VOLUME in `docker inspect -f '{{range .Mounts}}{{if .Name}}{{.Name}} {{end}}{{end}}' $CONTAINER`; do
+        echo ",{\"from\": \"container:$CONTAINER\", \"to\": \"volume:$VOLUME\", \"type\": \"MOUNTS_VOLUME\"}"
+    done
+done
+echo ']}'
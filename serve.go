@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// runServe exposes the CMDB as an HTTP/JSON API, so that other tools don't need the
+// credentials of the graph database:
+//
+//	graphcmdb serve [options]
+//
+// Every request needs one of the API keys, in the X-API-Key header or as a bearer
+// token. The keys of -write-api-keys also allow manual edits and triggering the
+// discovery of a server.
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	neoOptions := new(Neo4jOptions)
+	neoOptions.AddFlags(flags)
+	listen := flags.String("listen", ":8080", "address the API listens on")
+	tlsCert := flags.String("tls-cert", "", "certificate file, to serve HTTPS")
+	tlsKey := flags.String("tls-key", "", "private key file of -tls-cert")
+	cacheTTL := flags.Duration("cache", 30*time.Second, "how long the graph is cached between reads")
+	server := &apiServer{
+		readKeys:  splitKeys(os.Getenv("GRAPHCMDB_API_KEYS")),
+		writeKeys: splitKeys(os.Getenv("GRAPHCMDB_WRITE_API_KEYS")),
+		sshPass:   os.Getenv("GRAPHCMDB_SSH_PASSWORD"),
+	}
+	flags.Func("api-keys", "comma separated read only API keys (default from GRAPHCMDB_API_KEYS)", func(value string) error {
+		server.readKeys = splitKeys(value)
+		return nil
+	})
+	flags.Func("write-api-keys", "comma separated API keys also allowed to write (default from GRAPHCMDB_WRITE_API_KEYS)", func(value string) error {
+		server.writeKeys = splitKeys(value)
+		return nil
+	})
+	flags.StringVar(&server.sshUser, "ssh-user", "", "SSH user of the discovery triggered through the API")
+	flags.Func("ssh-pass", "SSH password of the discovery triggered through the API (default from GRAPHCMDB_SSH_PASSWORD)", func(value string) error {
+		server.sshPass = value
+		return nil
+	})
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "Usage: graphcmdb serve [options]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	if len(server.readKeys) == 0 && len(server.writeKeys) == 0 {
+		log.Fatal("No API key: set -api-keys or -write-api-keys")
+	}
+
+	ctx := context.Background()
+	store, err := NewStore(ctx, neoOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+	server.store = store
+	server.cacheTTL = *cacheTTL
+	server.plugins = LoadPlugins("./plugins")
+	server.web = webHandler()
+	server.schema, err = NewGraphQLSchema(server.plugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("GraphQL types: " + strings.Join(graphqlLabels(server.schema), ", "))
+
+	httpServer := &http.Server{Addr: *listen, Handler: server.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	log.Println("Serve the CMDB API on " + *listen)
+	if *tlsCert != "" {
+		err = httpServer.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	log.Fatal(err)
+}
+
+func splitKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// apiServer serves the CMDB API. Store accesses are serialized, the Neo4j store using a
+// single session, and the graph is cached for cacheTTL between writes.
+type apiServer struct {
+	store     GraphStore
+	plugins   []*Plugin
+	readKeys  []string
+	writeKeys []string
+	sshUser   string
+	sshPass   string
+	cacheTTL  time.Duration
+	schema    graphql.Schema
+	web       http.Handler
+
+	mu       sync.Mutex
+	graph    *Graph
+	loadedAt time.Time
+}
+
+// Handler routes the requests on their escaped path: http.ServeMux would clean the
+// "/" of the escaped names away.
+func (s *apiServer) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		switch {
+		case path == "/api/servers":
+			s.handleServers(w, r)
+		case strings.HasPrefix(path, "/api/servers/"):
+			s.handleDiscover(w, r)
+		case strings.HasPrefix(path, "/api/nodes/"):
+			s.handleNode(w, r)
+		case path == "/graphql":
+			s.handleGraphQL(w, r)
+		case path == "/" || path == "/ui":
+			http.Redirect(w, r, "/ui/", http.StatusFound)
+		case strings.HasPrefix(path, "/ui/"):
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			s.web.ServeHTTP(w, r)
+		default:
+			writeAPIError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+// apiNode is a configuration item with the source of its properties and, when
+// requested, its relationships.
+type apiNode struct {
+	Label         string            `json:"label"`
+	Name          string            `json:"name"`
+	Properties    map[string]any    `json:"properties"`
+	Sources       map[string]string `json:"sources,omitempty"`
+	Relationships []apiRelationship `json:"relationships,omitempty"`
+}
+
+// apiRelationship is a relationship of a node, from the node when direction is "out"
+// and to it when "in", to the node of label and name.
+type apiRelationship struct {
+	Type       string         `json:"type"`
+	Direction  string         `json:"direction"`
+	Label      string         `json:"label"`
+	Name       string         `json:"name"`
+	Properties map[string]any `json:"properties"`
+}
+
+type apiPage struct {
+	Items  []apiNode `json:"items"`
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+}
+
+func newAPINode(node *Node) apiNode {
+	properties := copyProperties(node.properties)
+	delete(properties, propertySourcesField)
+
+	return apiNode{Label: node.class, Name: node.name, Properties: properties, Sources: propertySources(node.properties)}
+}
+
+func newAPINodeWithRelationships(graph *Graph, node *Node) apiNode {
+	result := newAPINode(node)
+	result.Relationships = []apiRelationship{}
+	for _, r := range graph.relationships {
+		if r.left == node {
+			result.Relationships = append(result.Relationships, apiRelationship{Type: r.class, Direction: "out", Label: r.right.class, Name: r.right.name, Properties: r.properties})
+		}
+		if r.right == node {
+			result.Relationships = append(result.Relationships, apiRelationship{Type: r.class, Direction: "in", Label: r.left.class, Name: r.left.name, Properties: r.properties})
+		}
+	}
+
+	return result
+}
+
+// authorize checks the API key of the request, which must be a write key when write is
+// set, and writes the error response otherwise.
+func (s *apiServer) authorize(w http.ResponseWriter, r *http.Request, write bool) bool {
+	key := r.Header.Get("X-API-Key")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		key = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	if key != "" && containsKey(s.writeKeys, key) {
+		return true
+	}
+	if key != "" && containsKey(s.readKeys, key) {
+		if !write {
+			return true
+		}
+		writeAPIError(w, http.StatusForbidden, "this API key is read only")
+		return false
+	}
+
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeAPIError(w, http.StatusUnauthorized, "missing or invalid API key")
+	return false
+}
+
+func containsKey(keys []string, key string) bool {
+	found := false
+	for _, candidate := range keys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			found = true
+		}
+	}
+
+	return found
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Println("Can't write API response: " + err.Error())
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
+
+// loadGraph returns the cached graph, reloading it from the store once expired. It must
+// be called with s.mu held.
+func (s *apiServer) loadGraph(ctx context.Context) (*Graph, error) {
+	if s.graph != nil && time.Since(s.loadedAt) < s.cacheTTL {
+		return s.graph, nil
+	}
+
+	graph, err := s.store.Query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	graph.Sort()
+	s.graph = graph
+	s.loadedAt = time.Now()
+
+	return graph, nil
+}
+
+// currentGraph returns the graph for a read request, writing the error response when
+// it can't be loaded.
+func (s *apiServer) currentGraph(w http.ResponseWriter, r *http.Request) *Graph {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	graph, err := s.loadGraph(r.Context())
+	if err != nil {
+		log.Println("Can't load the graph: " + err.Error())
+		writeAPIError(w, http.StatusServiceUnavailable, "can't load the graph")
+		return nil
+	}
+
+	return graph
+}
+
+// apply writes batch to the store and invalidates the cached graph.
+func (s *apiServer) apply(ctx context.Context, batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.graph = nil
+	return s.store.Apply(ctx, batch)
+}
+
+// applyRun writes the discovery run and the batch collected by it to the store and
+// invalidates the cached graph.
+func (s *apiServer) applyRun(ctx context.Context, run *DiscoveryRun, batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.graph = nil
+	if err := run.Start(s.store, ctx); err != nil {
+		return err
+	}
+	if err := s.store.Apply(ctx, batch); err != nil {
+		return err
+	}
+
+	return run.Finish(s.store, ctx)
+}
+
+// pagination reads the offset and limit parameters, 50 items and at most 500 by default.
+func pagination(r *http.Request) (int, int, error) {
+	offset, limit := 0, 50
+	var err error
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset " + value)
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 500 {
+			return 0, 0, errors.New("invalid limit " + value + ", expected 1 to 500")
+		}
+	}
+
+	return offset, limit, nil
+}
+
+// handleServers lists the servers whose name or ip contains the q parameter:
+//
+//	GET /api/servers?q=web&offset=0&limit=50
+func (s *apiServer) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.authorize(w, r, false) {
+		return
+	}
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	graph := s.currentGraph(w, r)
+	if graph == nil {
+		return
+	}
+
+	servers := searchServers(graph, r.URL.Query().Get("q"))
+	page := apiPage{Items: []apiNode{}, Total: len(servers), Offset: offset, Limit: limit}
+	for i := offset; i < len(servers) && i < offset+limit; i++ {
+		page.Items = append(page.Items, newAPINode(servers[i]))
+	}
+	writeAPIJSON(w, http.StatusOK, page)
+}
+
+// searchServers returns the servers whose name or ip contains query, ignoring case.
+func searchServers(graph *Graph, query string) []*Node {
+	query = strings.ToLower(query)
+	var servers []*Node
+	for _, node := range graph.nodes {
+		if node.class == "Server" && (strings.Contains(strings.ToLower(node.name), query) || strings.Contains(strings.ToLower(fmt.Sprint(node.properties["ip"])), query)) {
+			servers = append(servers, node)
+		}
+	}
+
+	return servers
+}
+
+// handleDiscover runs the discovery of one server with the loaded plugins:
+//
+//	POST /api/servers/{name}/discover
+func (s *apiServer) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	segments, err := pathSegments(r, "/api/servers/")
+	if err != nil || len(segments) != 2 || segments[1] != "discover" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.authorize(w, r, true) {
+		return
+	}
+	if s.sshUser == "" {
+		writeAPIError(w, http.StatusNotImplemented, "discovery is disabled, start serve with -ssh-user")
+		return
+	}
+	graph := s.currentGraph(w, r)
+	if graph == nil {
+		return
+	}
+	node := graph.Node(nodeKey("Server", segments[0]))
+	if node == nil || node.properties["ip"] == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown server "+segments[0])
+		return
+	}
+
+	run := NewDiscoveryRun(s.plugins)
+	log.Println("Start discovery run " + run.id + " of server " + node.name + " requested through the API")
+	batch, results, err := collectServer(s.plugins, run, Server{vmName: node.name, IP: fmt.Sprint(node.properties["ip"])}, s.sshUser, s.sshPass)
+	if err == nil {
+		err = s.applyRun(r.Context(), run, batch)
+	}
+	if err != nil {
+		log.Println("Discovery of server " + node.name + " failed: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "discovery failed")
+		return
+	}
+
+	checks := []map[string]any{}
+	for _, result := range results {
+		checks = append(checks, map[string]any{"plugin": result.plugin, "target": result.target, "state": result.state, "details": result.details})
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{"run_id": run.id, "server": node.name, "checks": checks})
+}
+
+// handleNode serves a configuration item, names containing "/" being escaped as %2F:
+//
+//	GET    /api/nodes/{label}/{name}            the item and its relationships
+//	GET    /api/nodes/{label}/{name}/neighbors  the item and the items attached to it
+//	GET    /api/nodes/{label}/{name}/impact     see impact, with the depth, traverse and direction parameters
+//	PUT    /api/nodes/{label}/{name}            {"properties": {...}} set manually, creating the item if needed
+//	DELETE /api/nodes/{label}/{name}
+func (s *apiServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	segments, err := pathSegments(r, "/api/nodes/")
+	if err != nil || len(segments) < 2 || len(segments) > 3 || (len(segments) == 3 && segments[2] != "neighbors" && segments[2] != "impact") {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	label, name := segments[0], segments[1]
+
+	switch {
+	case r.Method == http.MethodGet:
+	case len(segments) == 2 && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		if s.authorize(w, r, true) {
+			s.writeNode(w, r, label, name)
+		}
+		return
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !s.authorize(w, r, false) {
+		return
+	}
+	graph := s.currentGraph(w, r)
+	if graph == nil {
+		return
+	}
+	node := graph.Node(nodeKey(label, name))
+	if node == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown "+label+" "+name)
+		return
+	}
+
+	if len(segments) == 2 {
+		writeAPIJSON(w, http.StatusOK, newAPINodeWithRelationships(graph, node))
+		return
+	}
+	if segments[2] == "neighbors" {
+		neighborhood := graph.Neighborhood(nodeKey(label, name))
+		neighborhood.Sort()
+		writeAPIJSON(w, http.StatusOK, neighborhood)
+		return
+	}
+
+	query := r.URL.Query()
+	traverse := query.Get("traverse")
+	if traverse == "" {
+		traverse = defaultImpactTraversal
+	}
+	traversal, err := parseImpactTraversal(traverse)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if direction := query.Get("direction"); direction != "" {
+		if direction != "in" && direction != "out" && direction != "both" {
+			writeAPIError(w, http.StatusBadRequest, "invalid direction "+direction+", expected in, out or both")
+			return
+		}
+		for class := range traversal {
+			traversal[class] = direction
+		}
+	}
+	depth := 3
+	if value := query.Get("depth"); value != "" {
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid depth "+value)
+			return
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, NewImpact(graph, node, traversal, depth))
+}
+
+// writeNode sets the properties of a node manually or deletes it, under the identity
+// keys of its label like runNode.
+func (s *apiServer) writeNode(w http.ResponseWriter, r *http.Request, label string, name string) {
+	if !identifierRegexp.MatchString(label) || isBookkeeping(label) {
+		writeAPIError(w, http.StatusBadRequest, "invalid label "+label)
+		return
+	}
+
+	graph := s.currentGraph(w, r)
+	if graph == nil {
+		return
+	}
+	existing, err := findManualNode(graph, label, name)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	node := &Node{class: label, name: name, properties: map[string]any{}}
+	if existing != nil {
+		node.keys = storedIdentity(existing, s.plugins)
+	}
+	batch := NewBatch()
+	batch.SetSource(manualSource)
+	if r.Method == http.MethodDelete {
+		if existing == nil {
+			writeAPIError(w, http.StatusNotFound, "unknown "+label+" "+name)
+			return
+		}
+		if err := batch.DeleteNode(node); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		var body struct {
+			Properties map[string]any `json:"properties"`
+		}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := checkManualFields(sortedKeys(body.Properties)); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for field, value := range body.Properties {
+			converted, ok := fragmentValue(value)
+			if !ok {
+				writeAPIError(w, http.StatusBadRequest, "property "+field+" is not a scalar or a list of scalars")
+				return
+			}
+			node.properties[field] = converted
+		}
+		if existing == nil {
+			keys, err := manualIdentity(label, name, node.properties, s.plugins)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := checkNewIdentity(graph, label, name, keys, s.plugins); err != nil {
+				writeAPIError(w, http.StatusConflict, err.Error())
+				return
+			}
+			node.keys = keys
+		}
+		if err := batch.UpsertNode(node, true, true); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if err := s.apply(r.Context(), batch); err != nil {
+		log.Println("Can't write " + label + " " + name + ": " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "can't write "+label+" "+name)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if graph = s.currentGraph(w, r); graph == nil {
+		return
+	}
+	if updated, _ := findManualNode(graph, label, name); updated != nil {
+		writeAPIJSON(w, http.StatusOK, newAPINodeWithRelationships(graph, updated))
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, "unknown "+label+" "+name)
+}
+
+// pathSegments returns the unescaped segments of the request path after prefix.
+func pathSegments(r *http.Request, prefix string) ([]string, error) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil || unescaped == "" {
+			return nil, errors.New("invalid path " + r.URL.EscapedPath())
+		}
+		segments[i] = unescaped
+	}
+
+	return segments, nil
+}
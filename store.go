@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// GraphStore persists the configuration items and the relationships between them.
+// Nodes and relationships are upserted and deleted through the operations queued in a
+// Batch, which the store applies atomically, so the discovery does not depend on the
+// database it writes to.
+type GraphStore interface {
+	// Apply runs every operation queued in batch: all of them are stored or none.
+	Apply(ctx context.Context, batch *Batch) error
+	// Query returns the current configuration items and relationships, without the
+	// bookkeeping nodes and relationships.
+	Query(ctx context.Context) (*Graph, error)
+	Close(ctx context.Context) error
+}
+
+// MemoryStore is a GraphStore keeping the graph in memory, for dry runs, tests and
+// offline exports. It does not record history nor tombstones.
+type MemoryStore struct {
+	graph *Graph
+}
+
+// NewMemoryStore returns a store starting from graph, or from an empty graph when nil.
+func NewMemoryStore(graph *Graph) *MemoryStore {
+	if graph == nil {
+		graph = NewGraph()
+	}
+
+	return &MemoryStore{graph: graph}
+}
+
+func (s *MemoryStore) Apply(ctx context.Context, batch *Batch) error {
+	seen := seenProperties(batch.run)
+
+	for _, queued := range batch.nodes {
+		matches := s.matchNodes(queued.node.class, queued.keys)
+		if len(matches) == 0 && queued.create {
+			node := &Node{class: queued.node.class, name: queued.node.name, properties: queued.writeProperties(nil)}
+			for k, v := range queued.keys {
+				node.properties[k] = v
+			}
+			node.properties["first_seen"] = seen["last_seen"]
+			if s.graph.Node(nodeKey(node.class, node.name)) != nil {
+				node.id = identityValue(node.class, queued.keys)
+			}
+			s.graph.AddNode(node)
+			matches = append(matches, node)
+		} else if queued.update {
+			for _, node := range matches {
+				for k, v := range queued.writeProperties(node.properties) {
+					node.properties[k] = v
+				}
+				node.name = queued.node.name
+			}
+		}
+
+		for _, node := range matches {
+			stampSeen(node.properties, seen)
+		}
+	}
+
+	for _, queued := range batch.relationships {
+		for _, r := range s.matchRelationships(queued, true) {
+			switch queued.mode {
+			case relationClaim:
+				if r.properties["plugin"] == nil || r.properties["plugin"] == queued.relationship.properties["plugin"] {
+					r.properties["plugin"] = queued.relationship.properties["plugin"]
+					r.properties["server"] = queued.relationship.properties["server"]
+					r.properties["active"] = true
+				}
+			case relationUpdate:
+				if r.properties["plugin"] == manualSource && !queued.manual {
+					break
+				}
+				for k, v := range queued.relationship.properties {
+					r.properties[k] = v
+				}
+			}
+			stampSeen(r.properties, seen)
+		}
+	}
+
+	for _, queued := range batch.deletes {
+		for _, r := range s.matchRelationships(queued, false) {
+			if r.properties["plugin"] != manualSource || queued.manual {
+				s.removeRelationship(r)
+			}
+		}
+	}
+
+	deleted := map[*Node]bool{}
+	for _, queued := range batch.nodeDeletes {
+		for _, node := range s.matchNodes(queued.node.class, queued.keys) {
+			deleted[node] = true
+		}
+	}
+	if len(deleted) > 0 {
+		s.graph = s.graph.Filter(func(n *Node) bool { return !deleted[n] })
+	}
+
+	for _, removal := range batch.removals {
+		for _, node := range s.matchNodes(removal.node.class, removal.keys) {
+			sources := propertySources(node.properties)
+			for _, field := range removal.removedFields(node.properties) {
+				delete(node.properties, field)
+				delete(sources, field)
+			}
+			delete(node.properties, propertySourcesField)
+			if len(sources) > 0 {
+				node.properties[propertySourcesField] = formatPropertySources(sources)
+			}
+		}
+	}
+
+	for _, reconcile := range batch.reconciles {
+		logReconcile(reconcile, s.reconcile(reconcile))
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Query(ctx context.Context) (*Graph, error) {
+	graph := NewGraph()
+	for _, node := range s.graph.nodes {
+		if !isBookkeeping(node.class) {
+			graph.AddNode(node)
+		}
+	}
+	for _, r := range s.graph.relationships {
+		if !isBookkeeping(r.class) && graph.Node(r.left.id) != nil && graph.Node(r.right.id) != nil {
+			graph.AddRelationship(r)
+		}
+	}
+
+	return graph, nil
+}
+
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// matchNodes returns the nodes with label whose properties hold the identity keys.
+func (s *MemoryStore) matchNodes(label string, keys map[string]any) []*Node {
+	var matches []*Node
+	for _, node := range s.graph.nodes {
+		if node.class != label {
+			continue
+		}
+		matched := true
+		for key, value := range keys {
+			if fmt.Sprint(node.properties[key]) != fmt.Sprint(value) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, node)
+		}
+	}
+
+	return matches
+}
+
+// matchRelationships returns the relationships between the nodes of queued, creating
+// the missing ones when create is set.
+func (s *MemoryStore) matchRelationships(queued *batchRelationship, create bool) []*Relationship {
+	var matches []*Relationship
+	for _, left := range s.matchNodes(queued.relationship.left.class, queued.leftKeys) {
+		for _, right := range s.matchNodes(queued.relationship.right.class, queued.rightKeys) {
+			found := false
+			for _, r := range s.graph.relationships {
+				if r.left == left && r.right == right && r.class == queued.relationship.class {
+					matches = append(matches, r)
+					found = true
+				}
+			}
+			if found || !create {
+				continue
+			}
+
+			r := &Relationship{left: left, class: queued.relationship.class, right: right, properties: map[string]any{}}
+			for k, v := range queued.relationship.properties {
+				r.properties[k] = v
+			}
+			s.graph.AddRelationship(r)
+			matches = append(matches, r)
+		}
+	}
+
+	return matches
+}
+
+func (s *MemoryStore) reconcile(reconcile batchReconcile) int64 {
+	seen := map[string]bool{}
+	for _, pair := range reconcile.seen {
+		seen[strings.Join(pair, "\x00")] = true
+	}
+
+	template := reconcile.template
+	var count int64
+	for _, r := range append([]*Relationship{}, s.graph.relationships...) {
+		if r.class != template.class || r.left.class != template.left.class || r.right.class != template.right.class ||
+			r.properties["plugin"] != template.properties["plugin"] || r.properties["server"] != template.properties["server"] ||
+			seen[r.left.name+"\x00"+r.right.name] {
+			continue
+		}
+
+		if reconcile.mode != "inactive" {
+			s.removeRelationship(r)
+		} else if r.properties["active"] != false {
+			r.properties["active"] = false
+		} else {
+			continue
+		}
+		count++
+	}
+
+	return count
+}
+
+func (s *MemoryStore) removeRelationship(r *Relationship) {
+	relationships := s.graph.relationships[:0]
+	for _, other := range s.graph.relationships {
+		if other != r {
+			relationships = append(relationships, other)
+		}
+	}
+	s.graph.relationships = relationships
+}
+
+// stampSeen records in properties that the entity has been observed now.
+func stampSeen(properties map[string]any, seen map[string]any) {
+	for k, v := range seen {
+		properties[k] = v
+	}
+	if properties["first_seen"] == nil {
+		properties["first_seen"] = seen["last_seen"]
+	}
+}
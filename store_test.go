@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// applyBatch queues writes in a batch of source and applies it to store.
+func applyBatch(t *testing.T, store *MemoryStore, source string, queue func(batch *Batch) error) {
+	t.Helper()
+	batch := NewBatch()
+	batch.SetSource(source)
+	if err := queue(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Apply(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedNode returns the node of label and name of store, nil when missing.
+func storedNode(store *MemoryStore, label string, name string) *Node {
+	for _, n := range store.graph.nodes {
+		if n.class == label && n.name == name {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// storedRelationships returns the properties of the relationships of class between
+// the nodes named left and right of store.
+func storedRelationships(store *MemoryStore, left string, class string, right string) []map[string]any {
+	var found []map[string]any
+	for _, r := range store.graph.relationships {
+		if r.left.name == left && r.class == class && r.right.name == right {
+			found = append(found, r.properties)
+		}
+	}
+
+	return found
+}
+
+func testServer(properties map[string]any) *Node {
+	return &Node{class: "Server", name: "web01", cond: "ip: '192.0.2.1'", properties: properties}
+}
+
+func testMount(plugin string, server string, storage string) *Relationship {
+	return &Relationship{left: testServer(nil), class: "HAS_MOUNT", right: &Node{class: "Storage", name: storage}, properties: map[string]any{"plugin": plugin, "server": server}}
+}
+
+func TestMemoryStoreNodeModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		create   bool
+		update   bool
+		want     map[string]any
+	}{
+		{"create a missing node", false, true, false, map[string]any{"ip": "192.0.2.1", "name": "web01", "os": "linux"}},
+		{"skip a missing node", false, false, true, nil},
+		{"update an existing node", true, false, true, map[string]any{"ip": "192.0.2.1", "name": "web01", "os": "linux"}},
+		{"only stamp an existing node", true, true, false, map[string]any{"ip": "192.0.2.1", "name": "web01", "os": "bsd"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore(nil)
+			if test.existing {
+				applyBatch(t, store, "", func(batch *Batch) error {
+					return batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1", "os": "bsd"}), true, true)
+				})
+			}
+			applyBatch(t, store, "", func(batch *Batch) error {
+				return batch.UpsertNode(testServer(map[string]any{"os": "linux"}), test.create, test.update)
+			})
+
+			node := storedNode(store, "Server", "web01")
+			if test.want == nil {
+				if node != nil {
+					t.Fatalf("node created: %v", node.properties)
+				}
+				return
+			}
+			if node == nil {
+				t.Fatal("node missing")
+			}
+			if node.properties["last_seen"] == nil || node.properties["first_seen"] == nil {
+				t.Errorf("node not stamped as seen: %v", node.properties)
+			}
+			if got := plannedProperties(node.properties); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreRelationshipModes(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string
+		mode  string
+		want  map[string]any
+	}{
+		{"create a missing relationship", "", relationCreate, map[string]any{"plugin": "mounts", "server": "web01", "source": "fstab"}},
+		{"create keeps an existing relationship", "nfs", relationCreate, map[string]any{"plugin": "nfs", "server": "web02", "active": false}},
+		{"claim an unowned relationship", "-", relationClaim, map[string]any{"plugin": "mounts", "server": "web01", "active": true}},
+		{"claim an own relationship", "mounts", relationClaim, map[string]any{"plugin": "mounts", "server": "web01", "active": true}},
+		{"claim keeps a relationship of another plugin", "nfs", relationClaim, map[string]any{"plugin": "nfs", "server": "web02", "active": false}},
+		{"update a relationship", "nfs", relationUpdate, map[string]any{"plugin": "mounts", "server": "web01", "active": false, "source": "fstab"}},
+		{"update keeps a manual relationship", manualSource, relationUpdate, map[string]any{"plugin": manualSource, "server": "web02", "active": false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore(nil)
+			applyBatch(t, store, "", func(batch *Batch) error {
+				if err := batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1"}), true, true); err != nil {
+					return err
+				}
+				return batch.UpsertNode(&Node{class: "Storage", name: "/data"}, true, true)
+			})
+			switch test.owner {
+			case "":
+			case "-":
+				applyBatch(t, store, "", func(batch *Batch) error {
+					return batch.UpsertRelationship(&Relationship{left: testServer(nil), class: "HAS_MOUNT", right: &Node{class: "Storage", name: "/data"}, properties: map[string]any{}}, relationCreate)
+				})
+			default:
+				applyBatch(t, store, "", func(batch *Batch) error {
+					mount := testMount(test.owner, "web02", "/data")
+					mount.properties["active"] = false
+					return batch.UpsertRelationship(mount, relationCreate)
+				})
+			}
+
+			applyBatch(t, store, "mounts", func(batch *Batch) error {
+				mount := testMount("mounts", "web01", "/data")
+				if test.mode != relationClaim {
+					mount.properties["source"] = "fstab"
+				}
+				return batch.UpsertRelationship(mount, test.mode)
+			})
+
+			found := storedRelationships(store, "web01", "HAS_MOUNT", "/data")
+			if len(found) != 1 {
+				t.Fatalf("got %d relationships, want 1", len(found))
+			}
+			if got := plannedProperties(found[0]); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreRelationshipNeedsBothNodes(t *testing.T) {
+	store := NewMemoryStore(nil)
+	applyBatch(t, store, "", func(batch *Batch) error {
+		if err := batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1"}), true, true); err != nil {
+			return err
+		}
+		return batch.UpsertRelationship(testMount("mounts", "web01", "/missing"), relationCreate)
+	})
+
+	if len(store.graph.relationships) != 0 || storedNode(store, "Storage", "/missing") != nil {
+		t.Errorf("relationship to a missing node created")
+	}
+}
+
+func TestMemoryStoreReconcile(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		want map[string][]map[string]any
+	}{
+		{"delete", "delete", map[string][]map[string]any{
+			"/data":   {{"plugin": "mounts", "server": "web01"}},
+			"/old":    nil,
+			"/nfs":    {{"plugin": "nfs", "server": "web01"}},
+			"/shared": {{"plugin": "mounts", "server": "web02"}},
+			"/manual": {{"plugin": manualSource, "server": "web01"}},
+		}},
+		{"inactive", "inactive", map[string][]map[string]any{
+			"/data":   {{"plugin": "mounts", "server": "web01"}},
+			"/old":    {{"plugin": "mounts", "server": "web01", "active": false}},
+			"/nfs":    {{"plugin": "nfs", "server": "web01"}},
+			"/shared": {{"plugin": "mounts", "server": "web02"}},
+			"/manual": {{"plugin": manualSource, "server": "web01"}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore(nil)
+			applyBatch(t, store, "", func(batch *Batch) error {
+				if err := batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1"}), true, true); err != nil {
+					return err
+				}
+				for _, mount := range []*Relationship{
+					testMount("mounts", "web01", "/data"),
+					testMount("mounts", "web01", "/old"),
+					testMount("nfs", "web01", "/nfs"),
+					testMount("mounts", "web02", "/shared"),
+					testMount(manualSource, "web01", "/manual"),
+				} {
+					if err := batch.UpsertNode(mount.right, true, false); err != nil {
+						return err
+					}
+					if err := batch.UpsertRelationship(mount, relationCreate); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			applyBatch(t, store, "mounts", func(batch *Batch) error {
+				batch.Reconcile(testMount("mounts", "web01", ""), [][]string{{"web01", "/data"}}, test.mode)
+				return nil
+			})
+
+			for storage, want := range test.want {
+				var got []map[string]any
+				for _, properties := range storedRelationships(store, "web01", "HAS_MOUNT", storage) {
+					got = append(got, plannedProperties(properties))
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got %v, want %v", storage, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreManualEdits(t *testing.T) {
+	store := NewMemoryStore(nil)
+	running := func(properties map[string]any) *Relationship {
+		return &Relationship{left: testServer(nil), class: "RUNNING", right: &Node{class: "Service", name: "nginx"}, properties: properties}
+	}
+	applyBatch(t, store, "discovery", func(batch *Batch) error {
+		if err := batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1", "os": "linux"}), true, true); err != nil {
+			return err
+		}
+		return batch.UpsertNode(&Node{class: "Service", name: "nginx"}, true, true)
+	})
+	applyBatch(t, store, manualSource, func(batch *Batch) error {
+		if err := batch.UpsertNode(testServer(map[string]any{"os": "bsd", "owner": "ops"}), false, true); err != nil {
+			return err
+		}
+		return batch.UpsertRelationship(running(map[string]any{"plugin": manualSource, "port": "80"}), relationUpdate)
+	})
+
+	applyBatch(t, store, "discovery", func(batch *Batch) error {
+		if err := batch.UpsertNode(testServer(map[string]any{"os": "linux", "owner": "nobody", "kernel": "6.1"}), false, true); err != nil {
+			return err
+		}
+		if err := batch.UpsertRelationship(running(map[string]any{"plugin": "services", "port": "8080"}), relationUpdate); err != nil {
+			return err
+		}
+		return batch.DeleteRelationship(running(nil))
+	})
+
+	server := storedNode(store, "Server", "web01")
+	for field, want := range map[string]any{"os": "bsd", "owner": "ops", "kernel": "6.1"} {
+		if server.properties[field] != want {
+			t.Errorf("%s = %v, want %v", field, server.properties[field], want)
+		}
+	}
+	wantSources := map[string]string{"ip": "discovery", "os": manualSource, "owner": manualSource, "kernel": "discovery"}
+	if got := propertySources(server.properties); !reflect.DeepEqual(got, wantSources) {
+		t.Errorf("sources %v, want %v", got, wantSources)
+	}
+	if found := storedRelationships(store, "web01", "RUNNING", "nginx"); len(found) != 1 || found[0]["port"] != "80" {
+		t.Errorf("manual relationship changed by discovery: %v", found)
+	}
+
+	applyBatch(t, store, manualSource, func(batch *Batch) error {
+		if err := batch.RemoveProperties(testServer(nil), []string{"os", "owner"}); err != nil {
+			return err
+		}
+		return batch.DeleteRelationship(running(nil))
+	})
+	if _, found := server.properties["owner"]; found {
+		t.Errorf("owner not removed: %v", server.properties)
+	}
+	wantSources = map[string]string{"ip": "discovery", "kernel": "discovery"}
+	if got := propertySources(server.properties); !reflect.DeepEqual(got, wantSources) {
+		t.Errorf("sources %v, want %v", got, wantSources)
+	}
+	if found := storedRelationships(store, "web01", "RUNNING", "nginx"); len(found) != 0 {
+		t.Errorf("manual relationship not deleted manually: %v", found)
+	}
+
+	applyBatch(t, store, "discovery", func(batch *Batch) error {
+		return batch.UpsertNode(testServer(map[string]any{"os": "linux"}), false, true)
+	})
+	if server.properties["os"] != "linux" || propertySources(server.properties)["os"] != "discovery" {
+		t.Errorf("discovery can't set a property removed manually: %v", server.properties)
+	}
+}
+
+func TestMemoryStoreProvenance(t *testing.T) {
+	store := NewMemoryStore(nil)
+	applyBatch(t, store, "packages", func(batch *Batch) error {
+		return batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1", "os": "linux", "kernel": "6.1"}), true, true)
+	})
+	applyBatch(t, store, "kernel", func(batch *Batch) error {
+		return batch.UpsertNode(testServer(map[string]any{"os": "linux", "kernel": "6.2"}), false, true)
+	})
+
+	want := map[string]string{"ip": "packages", "os": "packages", "kernel": "kernel"}
+	if got := propertySources(storedNode(store, "Server", "web01").properties); !reflect.DeepEqual(got, want) {
+		t.Errorf("sources %v, want %v", got, want)
+	}
+}
+
+func TestMemoryStoreDeleteNode(t *testing.T) {
+	store := NewMemoryStore(nil)
+	applyBatch(t, store, "", func(batch *Batch) error {
+		if err := batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1"}), true, true); err != nil {
+			return err
+		}
+		if err := batch.UpsertNode(&Node{class: "Storage", name: "/data"}, true, true); err != nil {
+			return err
+		}
+		return batch.UpsertRelationship(testMount("mounts", "web01", "/data"), relationCreate)
+	})
+	applyBatch(t, store, manualSource, func(batch *Batch) error {
+		return batch.DeleteNode(&Node{class: "Storage", name: "/data"})
+	})
+
+	graph, err := store.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.nodes) != 1 || len(graph.relationships) != 0 {
+		t.Errorf("got %d nodes and %d relationships, want the server alone", len(graph.nodes), len(graph.relationships))
+	}
+}
+
+func TestMemoryStoreRunStamps(t *testing.T) {
+	store := NewMemoryStore(nil)
+	first, second := NewDiscoveryRun(nil), NewDiscoveryRun(nil)
+	if err := first.Start(store, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	applyBatch(t, store, "", func(batch *Batch) error {
+		batch.SetRun(second)
+		return batch.UpsertNode(testServer(map[string]any{"ip": "192.0.2.1"}), true, true)
+	})
+	applyBatch(t, store, "", func(batch *Batch) error {
+		return batch.UpsertNode(&Node{class: "Storage", name: "/data"}, true, true)
+	})
+
+	for _, test := range []struct {
+		label string
+		name  string
+		want  any
+	}{{"DiscoveryRun", first.id, first.id}, {"Server", "web01", second.id}, {"Storage", "/data", nil}} {
+		if got := storedNode(store, test.label, test.name).properties["last_run_id"]; got != test.want {
+			t.Errorf("%s %s last_run_id %v, want %v", test.label, test.name, got, test.want)
+		}
+	}
+}
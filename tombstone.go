@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Deleted nodes and relationships are kept as Tombstone nodes holding their label,
+// name, endpoints and properties at deletion time, so that the graph can be rebuilt
+// as it was at any past date.
+
+// recordRelationshipTombstones creates a Tombstone for every relationship matched by
+// match, which binds (a)-[c]->(b), moves the property history of the relationship to
+// it and returns the deletions. It must run in the deleting transaction, before the
+// relationships are deleted.
+func recordRelationshipTombstones(ctx context.Context, tx cypherTx, match string, params map[string]any, runID string) ([]ChangeEvent, error) {
+	records, err := tx.Run(ctx, match+" RETURN "+tx.ID("a")+" as left_id, "+tx.Label("a")+" as left_label, a.name as left_name, type(c) as type, "+tx.ID("c")+" as id, properties(c) as properties, "+
+		tx.Label("b")+" as right_label, b.name as right_name", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]any
+	var changes []ChangeEvent
+	for _, record := range records {
+		properties, _ := record.Get("properties")
+		encoded, err := json.Marshal(properties)
+		if err != nil {
+			return nil, err
+		}
+
+		row := tombstoneRow("relationship", properties.(map[string]any), runID)
+		row["type"] = recordString(record, "type")
+		row["left_label"] = recordString(record, "left_label")
+		row["left_name"] = recordString(record, "left_name")
+		row["right_label"] = recordString(record, "right_label")
+		row["right_name"] = recordString(record, "right_name")
+		row["name"] = row["left_name"].(string) + " -" + row["type"].(string) + "-> " + row["right_name"].(string)
+		row["properties"] = string(encoded)
+		id, _ := record.Get("id")
+		leftID, _ := record.Get("left_id")
+		rows = append(rows, map[string]any{"tombstone": row, "id": id, "left": leftID})
+		changes = append(changes, relationshipDeletedEvent(row, properties.(map[string]any)))
+	}
+
+	return changes, createRelationshipTombstones(ctx, tx, rows)
+}
+
+// recordNodeTombstones creates a Tombstone for every node matched by match, which binds
+// (n), and for every relationship that deleting the node will detach. The property
+// history of the node is moved to its Tombstone. It must run in the deleting
+// transaction, before the nodes are deleted. It returns the deletions of the nodes and
+// of their relationships.
+func recordNodeTombstones(ctx context.Context, tx cypherTx, match string, params map[string]any, runID string) ([]ChangeEvent, error) {
+	records, err := tx.Run(ctx, match+" RETURN "+tx.ID("n")+" as id, "+tx.Label("n")+" as label, properties(n) as properties", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []ChangeEvent
+	for _, record := range records {
+		id, _ := record.Get("id")
+		properties, _ := record.Get("properties")
+		encoded, err := json.Marshal(properties)
+		if err != nil {
+			return nil, err
+		}
+
+		detached, err := recordRelationshipTombstones(ctx, tx, "MATCH (a)-[c]->(b) WHERE ("+tx.ID("a")+" = $id OR "+tx.ID("b")+" = $id) AND NOT type(c) IN $bookkeepingTypes",
+			map[string]any{"id": id, "bookkeepingTypes": bookkeepingTypes}, runID)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, detached...)
+
+		row := tombstoneRow("node", properties.(map[string]any), runID)
+		row["label"] = recordString(record, "label")
+		row["name"], _ = properties.(map[string]any)["name"].(string)
+		row["properties"] = string(encoded)
+
+		_, err = tx.Run(ctx, "MATCH (n) WHERE "+tx.ID("n")+" = $id CREATE (t:Tombstone) SET t = $row WITH n, t MATCH (n)-[:HAS_CHANGE]->(c:Change) CREATE (t)-[:HAS_CHANGE]->(c)",
+			map[string]any{"id": id, "row": row})
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, nodeChangeEvent(changeNodeDeleted, &Node{class: row["label"].(string), name: row["name"].(string)}, properties.(map[string]any), nil))
+	}
+
+	return changes, nil
+}
+
+func tombstoneRow(kind string, properties map[string]any, runID string) map[string]any {
+	row := map[string]any{
+		"kind":       kind,
+		"deleted_at": formatTimestamp(time.Now()),
+		"first_seen": "",
+		"run_id":     runID,
+	}
+	if firstSeen, found := properties["first_seen"].(string); found {
+		row["first_seen"] = firstSeen
+	}
+
+	return row
+}
+
+// createRelationshipTombstones creates the tombstone of every row and links it to the
+// Change nodes of the relationship with id, created by createRelationshipChanges.
+func createRelationshipTombstones(ctx context.Context, tx cypherTx, rows []map[string]any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err := tx.Run(ctx, "UNWIND $rows as row CREATE (t:Tombstone) SET t = row.tombstone WITH t, row MATCH (a) WHERE "+tx.ID("a")+" = row.left "+
+		"MATCH (a)-[h:HAS_RELATIONSHIP_CHANGE]->(c:Change {relationship: row.id}) CREATE (t)-[:HAS_CHANGE]->(c) DELETE h", map[string]any{"rows": rows})
+
+	return err
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webFiles is the web UI served by serve under /ui/: a single page reading the API with
+// the key the user enters, kept in the browser session storage.
+//
+//go:embed web
+var webFiles embed.FS
+
+func webHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+}
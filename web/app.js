@@ -0,0 +1,409 @@
+// graphcmdb web UI: server search, item details and the topology of an item's
+// neighborhood, read from the HTTP API of graphcmdb serve.
+"use strict";
+
+const main = document.getElementById("main");
+const pageSize = 50;
+const labelColors = {Server: "#2680c2", Storage: "#de911d", Service: "#3ebd93"};
+const otherColors = ["#9446ed", "#e12d39", "#0e7c86", "#8d2b0b", "#486581", "#c65d7b"];
+
+function apiKey() {
+  return sessionStorage.getItem("graphcmdb-api-key");
+}
+
+class APIError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(path) {
+  const response = await fetch(path, {headers: {"X-API-Key": apiKey()}});
+  const body = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    if (response.status === 401) {
+      sessionStorage.removeItem("graphcmdb-api-key");
+    }
+    throw new APIError(response.status, body.error || response.statusText);
+  }
+  return body;
+}
+
+function nodePath(label, name) {
+  return "/api/nodes/" + encodeURIComponent(label) + "/" + encodeURIComponent(name);
+}
+
+function nodeHash(view, label, name) {
+  return "#/" + view + "/" + encodeURIComponent(label) + "/" + encodeURIComponent(name);
+}
+
+function element(tag, attributes, ...children) {
+  const result = document.createElement(tag);
+  for (const [name, value] of Object.entries(attributes || {})) {
+    result.setAttribute(name, value);
+  }
+  for (const child of children) {
+    result.append(child instanceof Node ? child : String(child));
+  }
+  return result;
+}
+
+function labelColor(label) {
+  if (!labelColors[label]) {
+    labelColors[label] = otherColors[Object.keys(labelColors).length % otherColors.length];
+  }
+  return labelColors[label];
+}
+
+function labelBadge(label) {
+  const badge = element("span", {class: "label"}, label);
+  badge.style.background = labelColor(label);
+  return badge;
+}
+
+function formatValue(value) {
+  if (Array.isArray(value)) {
+    return value.join(", ");
+  }
+  if (value !== null && typeof value === "object") {
+    return JSON.stringify(value);
+  }
+  return String(value);
+}
+
+function showError(error) {
+  if (error.status === 401) {
+    showLogin();
+    return;
+  }
+  main.replaceChildren(element("p", {class: "error"}, error.message));
+}
+
+function showLogin() {
+  document.getElementById("logout").hidden = true;
+  main.replaceChildren(document.getElementById("login-template").content.cloneNode(true));
+  document.getElementById("login-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    sessionStorage.setItem("graphcmdb-api-key", document.getElementById("login-key").value);
+    route();
+  });
+  document.getElementById("login-key").focus();
+}
+
+// showSearch lists the servers whose name or ip contains query.
+async function showSearch(query, offset) {
+  document.getElementById("search-input").value = query;
+  const page = await api("/api/servers?q=" + encodeURIComponent(query) + "&offset=" + offset + "&limit=" + pageSize);
+
+  const rows = page.items.map((server) => element("tr", {},
+    element("td", {}, element("a", {href: nodeHash("node", server.label, server.name)}, server.name)),
+    element("td", {}, formatValue(server.properties.ip ?? "")),
+    element("td", {}, formatValue(server.properties.last_seen ?? "")),
+    element("td", {}, element("a", {href: nodeHash("topology", server.label, server.name)}, "topology"))));
+
+  const pager = element("div", {class: "pager"},
+    element("span", {class: "muted"}, page.total === 0 ? "No server" : (page.offset + 1) + "-" + (page.offset + page.items.length) + " of " + page.total));
+  if (page.offset > 0) {
+    pager.append(element("a", {href: "#/search?q=" + encodeURIComponent(query) + "&offset=" + Math.max(0, page.offset - pageSize)}, "Previous"));
+  }
+  if (page.offset + page.items.length < page.total) {
+    pager.append(element("a", {href: "#/search?q=" + encodeURIComponent(query) + "&offset=" + (page.offset + pageSize)}, "Next"));
+  }
+
+  main.replaceChildren(element("section", {class: "panel"},
+    element("h1", {}, query ? "Servers matching “" + query + "”" : "Servers"),
+    element("table", {},
+      element("thead", {}, element("tr", {}, element("th", {}, "Name"), element("th", {}, "IP"), element("th", {}, "Last seen"), element("th", {}))),
+      element("tbody", {}, ...rows)),
+    pager));
+}
+
+// showNode shows the properties of an item with their source, its relationships and
+// the number of items affected by its failure.
+async function showNode(label, name) {
+  const [node, impact] = await Promise.all([
+    api(nodePath(label, name)),
+    api(nodePath(label, name) + "/impact").catch(() => null),
+  ]);
+
+  const properties = Object.keys(node.properties).sort().map((field) => element("tr", {},
+    element("th", {}, field),
+    element("td", {}, formatValue(node.properties[field])),
+    element("td", {class: "source"}, node.sources && node.sources[field] ? node.sources[field] : "")));
+
+  const relationships = node.relationships.map((r) => element("tr", {},
+    element("td", {}, r.direction === "out" ? r.type + " →" : "← " + r.type),
+    element("td", {}, labelBadge(r.label), " ", element("a", {href: nodeHash("node", r.label, r.name)}, r.name)),
+    element("td", {class: "muted"}, Object.keys(r.properties).sort()
+      .filter((field) => field !== "first_seen" && field !== "last_seen")
+      .map((field) => field + ": " + formatValue(r.properties[field])).join(", "))));
+
+  const sections = [
+    element("section", {class: "panel"},
+      element("h1", {}, labelBadge(node.label), " ", node.name),
+      element("p", {}, element("a", {href: nodeHash("topology", node.label, node.name)}, "Show topology")),
+      element("table", {}, element("tbody", {}, ...properties))),
+    element("section", {class: "panel"},
+      element("h2", {}, "Relationships (" + node.relationships.length + ")"),
+      relationships.length ? element("table", {}, element("tbody", {}, ...relationships)) : element("p", {class: "muted"}, "No relationship")),
+  ];
+  if (impact) {
+    const affected = Object.keys(impact.affected).sort().map((affectedLabel) => element("tr", {},
+      element("th", {}, affectedLabel),
+      element("td", {}, ...impact.affected[affectedLabel].flatMap((item, i) => [
+        i ? ", " : "", element("a", {href: nodeHash("node", affectedLabel, item.name)}, item.name)]))));
+    sections.push(element("section", {class: "panel"},
+      element("h2", {}, "Impact of a failure"),
+      affected.length ? element("table", {}, element("tbody", {}, ...affected)) : element("p", {class: "muted"}, "No affected item")));
+  }
+  main.replaceChildren(...sections);
+}
+
+// Topology is the interactive view of the neighborhood of an item: the nodes are laid
+// out by a small force simulation, can be dragged, and a double click adds the
+// neighborhood of a node to the view.
+class Topology {
+  constructor(svg, center) {
+    this.svg = svg;
+    this.center = center;
+    this.nodes = new Map();
+    this.relationships = new Map();
+    this.hiddenTypes = new Set();
+    this.dragged = null;
+  }
+
+  add(graph) {
+    const width = this.svg.clientWidth || 800;
+    const height = this.svg.clientHeight || 600;
+    for (const node of graph.nodes) {
+      if (!this.nodes.has(node.id)) {
+        const anchor = this.nodes.get(this.anchor) || {x: width / 2, y: height / 2};
+        this.nodes.set(node.id, Object.assign({x: anchor.x + Math.random() * 80 - 40, y: anchor.y + Math.random() * 80 - 40, vx: 0, vy: 0}, node));
+      }
+    }
+    for (const r of graph.relationships) {
+      this.relationships.set(r.from + "-" + r.type + "-" + r.to, r);
+    }
+  }
+
+  types() {
+    return [...new Set([...this.relationships.values()].map((r) => r.type))].sort();
+  }
+
+  visibleRelationships() {
+    return [...this.relationships.values()].filter((r) => !this.hiddenTypes.has(r.type) && this.nodes.has(r.from) && this.nodes.has(r.to));
+  }
+
+  step() {
+    const nodes = [...this.nodes.values()];
+    const width = this.svg.clientWidth || 800;
+    const height = this.svg.clientHeight || 600;
+    for (const a of nodes) {
+      for (const b of nodes) {
+        if (a === b) {
+          continue;
+        }
+        const dx = a.x - b.x;
+        const dy = a.y - b.y;
+        const distance = Math.max(Math.hypot(dx, dy), 1);
+        const force = 2000 / (distance * distance);
+        a.vx += dx / distance * force;
+        a.vy += dy / distance * force;
+      }
+    }
+    for (const r of this.visibleRelationships()) {
+      const a = this.nodes.get(r.from);
+      const b = this.nodes.get(r.to);
+      const dx = b.x - a.x;
+      const dy = b.y - a.y;
+      const distance = Math.max(Math.hypot(dx, dy), 1);
+      const force = (distance - 120) * 0.02;
+      a.vx += dx / distance * force;
+      a.vy += dy / distance * force;
+      b.vx -= dx / distance * force;
+      b.vy -= dy / distance * force;
+    }
+    for (const node of nodes) {
+      node.vx += (width / 2 - node.x) * 0.002;
+      node.vy += (height / 2 - node.y) * 0.002;
+      if (node !== this.dragged) {
+        node.x = Math.min(width - 20, Math.max(20, node.x + node.vx));
+        node.y = Math.min(height - 20, Math.max(20, node.y + node.vy));
+      }
+      node.vx *= 0.6;
+      node.vy *= 0.6;
+    }
+  }
+
+  render() {
+    const ns = "http://www.w3.org/2000/svg";
+    const svgElement = (tag, attributes, text) => {
+      const result = document.createElementNS(ns, tag);
+      for (const [name, value] of Object.entries(attributes)) {
+        result.setAttribute(name, value);
+      }
+      if (text !== undefined) {
+        result.textContent = text;
+      }
+      return result;
+    };
+
+    const children = [];
+    for (const r of this.visibleRelationships()) {
+      const a = this.nodes.get(r.from);
+      const b = this.nodes.get(r.to);
+      const inactive = r.properties && r.properties.active === false;
+      children.push(svgElement("line", {class: "edge" + (inactive ? " inactive" : ""), x1: a.x, y1: a.y, x2: b.x, y2: b.y, "marker-end": "url(#arrow)"}));
+      children.push(svgElement("text", {class: "edge-label", x: (a.x + b.x) / 2, y: (a.y + b.y) / 2 - 3, "text-anchor": "middle"}, r.type));
+    }
+    for (const node of this.nodes.values()) {
+      const group = svgElement("g", {class: "node" + (node.id === this.center ? " center" : ""), transform: "translate(" + node.x + "," + node.y + ")"});
+      group.append(svgElement("circle", {r: 12, fill: labelColor(node.label)}));
+      group.append(svgElement("text", {x: 16, y: 4}, node.name));
+      group.append(svgElement("title", {}, node.label + " " + node.name + "\nClick for details, double click to expand"));
+      group.dataset.id = node.id;
+      children.push(group);
+    }
+
+    const defs = svgElement("defs", {});
+    const marker = svgElement("marker", {id: "arrow", viewBox: "0 0 10 10", refX: 22, refY: 5, markerWidth: 6, markerHeight: 6, orient: "auto"});
+    marker.append(svgElement("path", {d: "M0,0 L10,5 L0,10 z", fill: "#9fb3c8"}));
+    defs.append(marker);
+    this.svg.replaceChildren(defs, ...children);
+  }
+
+  animate(steps) {
+    for (let i = 0; i < steps; i++) {
+      this.step();
+    }
+    this.render();
+  }
+}
+
+// showTopology draws the neighborhood of an item, with a checkbox per relationship
+// type to hide or show it.
+async function showTopology(label, name) {
+  const graph = await api(nodePath(label, name) + "/neighbors");
+  const center = graph.nodes.find((node) => node.label === label && node.name === name);
+
+  const svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+  svg.id = "topology";
+  const toolbar = element("div", {class: "toolbar"});
+  const details = element("div", {class: "muted"}, "Click a node for its details, double click to add its neighbors, drag to move it.");
+  main.replaceChildren(element("section", {class: "panel"},
+    element("h1", {}, "Topology of ", labelBadge(label), " ", element("a", {href: nodeHash("node", label, name)}, name)),
+    toolbar, svg, details));
+
+  const topology = new Topology(svg, center && center.id);
+  topology.anchor = center && center.id;
+  topology.add(graph);
+
+  const updateToolbar = () => {
+    toolbar.replaceChildren(...topology.types().map((type) => {
+      const checkbox = element("input", {type: "checkbox"});
+      checkbox.checked = !topology.hiddenTypes.has(type);
+      checkbox.addEventListener("change", () => {
+        if (checkbox.checked) {
+          topology.hiddenTypes.delete(type);
+        } else {
+          topology.hiddenTypes.add(type);
+        }
+        topology.animate(100);
+      });
+      return element("label", {}, checkbox, " " + type);
+    }));
+  };
+  updateToolbar();
+  topology.animate(300);
+
+  const nodeAt = (event) => {
+    const group = event.target.closest(".node");
+    return group ? topology.nodes.get(group.dataset.id) : null;
+  };
+  const position = (event) => {
+    const box = svg.getBoundingClientRect();
+    return {x: event.clientX - box.left, y: event.clientY - box.top};
+  };
+  let moved = false;
+  svg.addEventListener("mousedown", (event) => {
+    topology.dragged = nodeAt(event);
+    moved = false;
+  });
+  svg.addEventListener("mousemove", (event) => {
+    if (topology.dragged) {
+      Object.assign(topology.dragged, position(event));
+      moved = true;
+      topology.animate(1);
+    }
+  });
+  for (const type of ["mouseup", "mouseleave"]) {
+    svg.addEventListener(type, () => {
+      topology.dragged = null;
+    });
+  }
+  svg.addEventListener("click", (event) => {
+    const node = nodeAt(event);
+    if (!node || moved) {
+      return;
+    }
+    const properties = Object.keys(node.properties || {}).sort()
+      .filter((field) => field !== "property_sources")
+      .map((field) => field + ": " + formatValue(node.properties[field])).join(", ");
+    details.replaceChildren(labelBadge(node.label), " ", element("a", {href: nodeHash("node", node.label, node.name)}, node.name), " ", properties);
+  });
+  svg.addEventListener("dblclick", async (event) => {
+    const node = nodeAt(event);
+    if (!node) {
+      return;
+    }
+    try {
+      topology.anchor = node.id;
+      topology.add(await api(nodePath(node.label, node.name) + "/neighbors"));
+      updateToolbar();
+      topology.animate(200);
+    } catch (error) {
+      details.replaceChildren(element("span", {class: "error"}, error.message));
+    }
+  });
+}
+
+// route shows the page of the location hash:
+//
+//	#/search?q=web&offset=0
+//	#/node/{label}/{name}
+//	#/topology/{label}/{name}
+async function route() {
+  if (!apiKey()) {
+    showLogin();
+    return;
+  }
+  document.getElementById("logout").hidden = false;
+
+  const hash = location.hash.replace(/^#\/?/, "");
+  const [path, query] = hash.split("?");
+  const segments = path.split("/").map(decodeURIComponent);
+  const params = new URLSearchParams(query || "");
+  try {
+    if ((segments[0] === "node" || segments[0] === "topology") && segments.length === 3) {
+      document.title = segments[2] + " - graphcmdb";
+      await (segments[0] === "node" ? showNode : showTopology)(segments[1], segments[2]);
+    } else {
+      document.title = "graphcmdb";
+      await showSearch(params.get("q") || "", Number(params.get("offset")) || 0);
+    }
+  } catch (error) {
+    showError(error);
+  }
+}
+
+document.getElementById("search-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  location.hash = "#/search?q=" + encodeURIComponent(document.getElementById("search-input").value);
+});
+document.getElementById("logout").addEventListener("click", () => {
+  sessionStorage.removeItem("graphcmdb-api-key");
+  showLogin();
+});
+window.addEventListener("hashchange", route);
+route();